@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+)
+
+// anonKey seeds the pseudonym mapping. It is random per process so the
+// pseudonyms can't be reversed by someone who only sees the output.
+var anonKey []byte
+
+// anonCache remembers the pseudonym handed out for each real address, so a
+// client keeps the same pseudonym for the lifetime of the process.
+var anonCache map[string]string = make(map[string]string)
+
+// anonymizeIP maps an IP address to a stable pseudonym of the same family.
+// The mapping is prefix-preserving: two addresses sharing their first n bits
+// map to pseudonyms that also share their first n bits, so subnet structure
+// survives anonymization. Anything that doesn't parse as an IP is returned
+// unchanged.
+func anonymizeIP(ip string) string {
+	if anon, ok := anonCache[ip]; ok {
+		return anon
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	addr := parsed.To4()
+	if addr == nil {
+		addr = parsed.To16()
+	}
+
+	if anonKey == nil {
+		anonKey = make([]byte, 32)
+		if _, err := rand.Read(anonKey); err != nil {
+			panic(err)
+		}
+	}
+
+	// Each output bit is the input bit XORed with a pseudorandom bit derived
+	// from all of the input bits before it (the Crypto-PAn construction, with
+	// HMAC-SHA256 standing in for AES).
+	out := make(net.IP, len(addr))
+	prefix := make([]byte, len(addr))
+	for i := 0; i < len(addr)*8; i++ {
+		mac := hmac.New(sha256.New, anonKey)
+		mac.Write(prefix)
+		mac.Write([]byte{byte(i)})
+		flip := mac.Sum(nil)[0] & 1
+
+		bit := (addr[i/8] >> (7 - i%8)) & 1
+		out[i/8] |= (bit ^ flip) << (7 - i%8)
+		prefix[i/8] |= bit << (7 - i%8)
+	}
+
+	anon := out.String()
+	anonCache[ip] = anon
+	return anon
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// BINLOG_THROUGH_GTID is the COM_BINLOG_DUMP_GTID flag saying a GTID set
+// follows the position
+const BINLOG_THROUGH_GTID = 0x04
+
+// binlogDump is where a replica asked to start reading the binlog, from
+// COM_BINLOG_DUMP (file and position) or COM_BINLOG_DUMP_GTID (optionally a
+// GTID set as well)
+type binlogDump struct {
+	serverID uint32
+	file     string
+	position uint64
+	gtidSet  string
+}
+
+func (d binlogDump) String() string {
+	text := fmt.Sprintf("server-id %d from %s:%d", d.serverID, d.file, d.position)
+	if d.gtidSet != "" {
+		text += " GTID " + d.gtidSet
+	}
+	return text
+}
+
+// parseBinlogDump decodes a COM_BINLOG_DUMP payload (after the command
+// byte): position (4), flags (2), server ID (4), then the file name
+func parseBinlogDump(data []byte) (binlogDump, error) {
+	if len(data) < 10 {
+		return binlogDump{}, errors.New("COM_BINLOG_DUMP too short")
+	}
+	return binlogDump{
+		position: uint64(binary.LittleEndian.Uint32(data[0:4])),
+		serverID: binary.LittleEndian.Uint32(data[6:10]),
+		file:     string(data[10:]),
+	}, nil
+}
+
+// parseBinlogDumpGTID decodes a COM_BINLOG_DUMP_GTID payload (after the
+// command byte): flags (2), server ID (4), file name length (4) and name,
+// position (8), then with BINLOG_THROUGH_GTID the size (4) and encoding of
+// a GTID set
+func parseBinlogDumpGTID(data []byte) (binlogDump, error) {
+	if len(data) < 10 {
+		return binlogDump{}, errors.New("COM_BINLOG_DUMP_GTID too short")
+	}
+	flags := binary.LittleEndian.Uint16(data[0:2])
+	d := binlogDump{serverID: binary.LittleEndian.Uint32(data[2:6])}
+	nameLen := int(binary.LittleEndian.Uint32(data[6:10]))
+	rest := data[10:]
+	if nameLen < 0 || len(rest) < nameLen+8 {
+		return binlogDump{}, errors.New("COM_BINLOG_DUMP_GTID cut short in the file name or position")
+	}
+	d.file = string(rest[:nameLen])
+	d.position = binary.LittleEndian.Uint64(rest[nameLen : nameLen+8])
+	rest = rest[nameLen+8:]
+
+	if flags&BINLOG_THROUGH_GTID != 0 {
+		if len(rest) < 4 || len(rest)-4 < int(binary.LittleEndian.Uint32(rest[0:4])) {
+			return binlogDump{}, errors.New("COM_BINLOG_DUMP_GTID cut short in the GTID set")
+		}
+		set, err := mysql.DecodeMysqlGTIDSet(rest[4 : 4+binary.LittleEndian.Uint32(rest[0:4])])
+		if err != nil {
+			return binlogDump{}, err
+		}
+		d.gtidSet = set.String()
+	}
+	return d, nil
+}
+
+// replicas is every binlog dump request seen, by source, for the status
+// update
+var replicas map[string]binlogDump = make(map[string]binlogDump)
+
+// recordBinlogDump notes a replica starting to read the binlog. Each request
+// is logged, so a replica that reconnects from a different position shows.
+func recordBinlogDump(rs *source, pType CommandType, data []byte) {
+	var d binlogDump
+	var err error
+	if pType == CommandType(mysql.COM_BINLOG_DUMP) {
+		d, err = parseBinlogDump(data)
+	} else {
+		d, err = parseBinlogDumpGTID(data)
+	}
+	if err != nil {
+		log.Printf("%sUnreadable %s from %s: %s%s", COLOR_YELLOW, pType.String(), rs.hostPort, err.Error(), COLOR_DEFAULT)
+		return
+	}
+
+	rs.replica = true
+	replicas[rs.hostPort] = d
+	log.Printf("%sReplica %s requested the binlog, %s%s", COLOR_CYAN, rs.hostPort, d, COLOR_DEFAULT)
+}
+
+// reportReplicas prints the replicas seen and where each started reading
+func reportReplicas() {
+	sources := make([]string, 0, len(replicas))
+	for src := range replicas {
+		sources = append(sources, src)
+	}
+	sort.Strings(sources)
+	lines := make([]string, 0, len(sources))
+	for _, src := range sources {
+		lines = append(lines, fmt.Sprintf("  %s %s", src, replicas[src]))
+	}
+	log.Printf("Replicas:\n%s", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// BINARY_CHARSET_ID is the character set number of binary columns, whose
+// values are bytes rather than text
+const BINARY_CHARSET_ID = 63
+
+// charsetEncodings maps MySQL character set names to their decoders. UTF-8,
+// ascii and binary need no decoding, and aren't listed; neither is anything
+// we can't decode, which is shown as-is.
+var charsetEncodings = map[string]encoding.Encoding{
+	"latin1":  charmap.Windows1252, // MySQL's latin1 is really cp1252
+	"latin2":  charmap.ISO8859_2,
+	"latin5":  charmap.ISO8859_9,
+	"latin7":  charmap.ISO8859_13,
+	"greek":   charmap.ISO8859_7,
+	"hebrew":  charmap.ISO8859_8,
+	"cp850":   charmap.CodePage850,
+	"cp866":   charmap.CodePage866,
+	"cp1250":  charmap.Windows1250,
+	"cp1251":  charmap.Windows1251,
+	"cp1256":  charmap.Windows1256,
+	"cp1257":  charmap.Windows1257,
+	"koi8r":   charmap.KOI8R,
+	"koi8u":   charmap.KOI8U,
+	"gbk":     simplifiedchinese.GBK,
+	"gb2312":  simplifiedchinese.GBK,
+	"gb18030": simplifiedchinese.GB18030,
+	"big5":    traditionalchinese.Big5,
+	"sjis":    japanese.ShiftJIS,
+	"cp932":   japanese.ShiftJIS,
+	"ujis":    japanese.EUCJP,
+	"eucjpms": japanese.EUCJP,
+	"euckr":   korean.EUCKR,
+}
+
+// sessionCharset is the character sets a session has asked for: client is
+// what its queries are written in, results what the server sends values in.
+// Empty means the server default, which we take to be UTF-8.
+type sessionCharset struct {
+	client  string
+	results string
+}
+
+// decodeCharset converts text in the named character set to UTF-8 for
+// display. Text we can't decode is returned unchanged.
+func decodeCharset(charset string, text string) string {
+	enc, ok := charsetEncodings[charset]
+	if !ok {
+		return text
+	}
+	decoded, err := enc.NewDecoder().String(text)
+	if err != nil {
+		return text
+	}
+	return decoded
+}
+
+// parseCharsetSet recognizes a statement changing the session's character
+// sets, returning the result: SET NAMES x [COLLATE y] and SET CHARACTER SET x
+// set both, while SET character_set_client = x and
+// SET character_set_results = x (with SESSION or @@session. and among other
+// assignments) set one each.
+func parseCharsetSet(query []byte, mode sqlMode, current sessionCharset) (charset sessionCharset, ok bool) {
+	var tokens []string
+	for i := 0; i < len(query); {
+		length, toktype := lexToken(query[i:], mode)
+		if toktype != TOKEN_WHITESPACE {
+			tokens = append(tokens, string(query[i:i+length]))
+		}
+		i += length
+	}
+	if len(tokens) == 0 || strings.ToUpper(tokens[0]) != "SET" {
+		return current, false
+	}
+
+	charset = current
+	for pos := 1; pos < len(tokens); {
+		// One assignment, up to the next top-level comma
+		end, depth := pos, 0
+		for end < len(tokens) && (depth > 0 || tokens[end] != ",") {
+			switch tokens[end] {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+			end++
+		}
+		assignment := tokens[pos:end]
+		pos = end + 1
+
+		switch {
+		case len(assignment) >= 2 && strings.ToUpper(assignment[0]) == "NAMES":
+			charset.client = charsetName(assignment[1])
+			charset.results, ok = charset.client, true
+			continue
+		case len(assignment) >= 3 && strings.ToUpper(assignment[0]) == "CHARACTER" && strings.ToUpper(assignment[1]) == "SET":
+			charset.client = charsetName(assignment[2])
+			charset.results, ok = charset.client, true
+			continue
+		case len(assignment) >= 2 && strings.ToUpper(assignment[0]) == "CHARSET":
+			charset.client = charsetName(assignment[1])
+			charset.results, ok = charset.client, true
+			continue
+		}
+
+		target, value := "", ""
+		for i, tok := range assignment {
+			if tok == "=" && i+1 < len(assignment) {
+				value = assignment[i+1]
+				break
+			}
+			if tok != ":" {
+				target += strings.ToLower(tok)
+			}
+		}
+		target = strings.TrimPrefix(target, "@@")
+		for _, scope := range []string{"session.", "local.", "session", "local"} {
+			target = strings.TrimPrefix(target, scope)
+		}
+
+		switch target {
+		case "character_set_client":
+			charset.client, ok = charsetName(value), true
+		case "character_set_results":
+			charset.results, ok = charsetName(value), true
+		}
+	}
+	return charset, ok
+}
+
+// charsetName normalizes a character set as written in a SET statement:
+// quoted or not, any case. DEFAULT and NULL (no conversion of results) come
+// back empty.
+func charsetName(token string) string {
+	if len(token) >= 2 && (token[0] == '\'' || token[0] == '"' || token[0] == '`') {
+		token = token[1 : len(token)-1]
+	}
+	switch name := strings.ToLower(token); name {
+	case "default", "null":
+		return ""
+	default:
+		return name
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// dedupRun is one query displayed over and over by a source
+type dedupRun struct {
+	query string
+	count uint64
+	last  time.Time
+}
+
+// verboseDeduper folds repeats of the same query from the same source, such
+// as an N+1 loop, into one line with -verbose-dedup. The first query of a run
+// is displayed in full; each repeat within the window of the one before it
+// only adds to the run's count, and when the run ends it's summed up as
+// "[src] x47 query" (47 executions in all, the first of them shown above).
+type verboseDeduper struct {
+	window time.Duration
+	runs   map[string]*dedupRun
+}
+
+var verboseDedup *verboseDeduper
+
+func newVerboseDeduper(window time.Duration) *verboseDeduper {
+	return &verboseDeduper{window: window, runs: make(map[string]*dedupRun)}
+}
+
+// repeat reports whether query from src repeats the source's last displayed
+// query within the window, and so shouldn't be displayed. Anything else ends
+// the source's run and starts a new one.
+func (d *verboseDeduper) repeat(src, query string, now time.Time) bool {
+	if run, ok := d.runs[src]; ok {
+		if run.query == query && now.Sub(run.last) <= d.window {
+			run.count++
+			run.last = now
+			return true
+		}
+		d.end(src)
+	}
+	d.runs[src] = &dedupRun{query: query, count: 1, last: now}
+	return false
+}
+
+// flush ends the runs that have gone a window without repeating, or every
+// run given the zero time, as at the end of a capture
+func (d *verboseDeduper) flush(now time.Time) {
+	sources := make([]string, 0, len(d.runs))
+	for src, run := range d.runs {
+		if now.IsZero() || now.Sub(run.last) > d.window {
+			sources = append(sources, src)
+		}
+	}
+	sort.Strings(sources)
+	for _, src := range sources {
+		d.end(src)
+	}
+}
+
+// end forgets src's run, printing its count if it repeated at all
+func (d *verboseDeduper) end(src string) {
+	run := d.runs[src]
+	delete(d.runs, src)
+	if run.count > 1 {
+		slog.Info(fmt.Sprintf("\n%s[%s]%s %sx%d%s %s%s%s", COLOR_CYAN, src, COLOR_DEFAULT,
+			COLOR_YELLOW, run.count, COLOR_DEFAULT, COLOR_WHITE, run.query, COLOR_DEFAULT))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// fragmentTimeout is how long the fragments of an incomplete datagram are
+// kept waiting for the rest
+const fragmentTimeout = 30 * time.Second
+
+// ipDefrag holds the fragments of IPv4 datagrams still being reassembled
+var ipDefrag = ip4defrag.NewIPv4Defragmenter()
+
+// defragment returns the packet to handle for a captured one. Anything that
+// isn't an IPv4 fragment comes back as is. Fragments are held until the last
+// one arrives, and then the reassembled datagram is decoded again from the IP
+// layer up so its TCP header and payload are whole.
+func defragment(packet gopacket.Packet) (gopacket.Packet, bool) {
+	ipLayer := packet.Layer(layers.LayerTypeIPv4)
+	if ipLayer == nil {
+		return packet, true
+	}
+	ip, _ := ipLayer.(*layers.IPv4)
+	if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+		return packet, true
+	}
+
+	ts := packet.Metadata().Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	ipDefrag.DiscardOlderThan(ts.Add(-fragmentTimeout))
+
+	whole, err := ipDefrag.DefragIPv4WithTimestamp(ip, ts)
+	if err != nil {
+		slog.Debug("dropping IP fragment", "src", ip.SrcIP, "id", ip.Id, "error", err)
+		return nil, false
+	}
+	if whole == nil {
+		return nil, false
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		whole, gopacket.Payload(whole.Payload))
+	if err != nil {
+		slog.Debug("failed to rebuild reassembled datagram", "src", ip.SrcIP, "id", ip.Id, "error", err)
+		return nil, false
+	}
+
+	reassembled := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	reassembled.Metadata().Timestamp = ts
+	return reassembled, true
+}
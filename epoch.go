@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// epoch is the stretch of a capture between two marker queries
+type epoch struct {
+	name    string
+	queries uint64
+	verbs   map[string]uint64
+}
+
+// epochTracker splits the capture into epochs at queries matching the
+// -epoch-marker pattern, such as SELECT 'EPOCH:phase2' issued by a load test
+// between its phases. The epoch is named by the pattern's first capture
+// group, or the whole match if it has none.
+type epochTracker struct {
+	marker *regexp.Regexp
+	epochs []*epoch
+}
+
+var epochs *epochTracker
+
+// newEpochTracker starts tracking with an epoch for whatever comes before the
+// first marker
+func newEpochTracker(marker *regexp.Regexp) *epochTracker {
+	t := &epochTracker{marker: marker}
+	t.start("(before first marker)")
+	return t
+}
+
+func (t *epochTracker) start(name string) {
+	t.epochs = append(t.epochs, &epoch{name: name, verbs: make(map[string]uint64)})
+}
+
+// mark starts a new epoch if the query is a marker, and reports whether it was
+func (t *epochTracker) mark(query []byte) bool {
+	m := t.marker.FindSubmatch(query)
+	if m == nil {
+		return false
+	}
+	name := m[0]
+	if len(m) > 1 {
+		name = m[1]
+	}
+	t.start(string(name))
+	return true
+}
+
+// count adds a query to the current epoch
+func (t *epochTracker) count(query []byte) {
+	e := t.epochs[len(t.epochs)-1]
+	e.queries++
+	e.verbs[queryVerb(query)]++
+}
+
+// report prints a section per epoch, oldest first. An empty opening epoch
+// (the capture started on a marker) is left out.
+func (t *epochTracker) report() {
+	for i, e := range t.epochs {
+		if i == 0 && e.queries == 0 && len(t.epochs) > 1 {
+			continue
+		}
+		verbs := make([]string, 0, len(e.verbs))
+		for verb := range e.verbs {
+			verbs = append(verbs, verb)
+		}
+		sort.Slice(verbs, func(i, j int) bool {
+			if e.verbs[verbs[i]] != e.verbs[verbs[j]] {
+				return e.verbs[verbs[i]] > e.verbs[verbs[j]]
+			}
+			return verbs[i] < verbs[j]
+		})
+		parts := make([]string, 0, len(verbs))
+		for _, verb := range verbs {
+			parts = append(parts, fmt.Sprintf("%s %d", verb, e.verbs[verb]))
+		}
+		log.Printf("Epoch %s: %d queries (%s)", e.name, e.queries, strings.Join(parts, ", "))
+	}
+}
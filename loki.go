@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// lokiEntry is one query event for Loki: its stream labels and log line
+type lokiEntry struct {
+	ts     time.Time
+	verb   string
+	source string
+	line   string
+}
+
+// lokiPusher sends query events to a Grafana Loki push endpoint. Like the
+// replayer, events go through a bounded queue to a single worker so a slow or
+// unreachable Loki never stalls capture; when the queue is full the event is
+// dropped. The worker batches events, pushing every interval or batchSize
+// events, and retries a failed push a few times before giving up on it.
+type lokiPusher struct {
+	url       string
+	host      string
+	client    *http.Client
+	queue     chan lokiEntry
+	done      chan struct{}
+	interval  time.Duration
+	batchSize int
+	retries   int
+	backoff   time.Duration
+
+	pushed  atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+var loki *lokiPusher
+
+// newLokiPusher creates a pusher to the Loki server at addr (a base URL such
+// as http://loki:3100), labelling every stream with host
+func newLokiPusher(addr, host string) *lokiPusher {
+	return &lokiPusher{
+		url:       strings.TrimSuffix(addr, "/") + "/loki/api/v1/push",
+		host:      host,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		queue:     make(chan lokiEntry, 4096),
+		done:      make(chan struct{}),
+		interval:  time.Second,
+		batchSize: 500,
+		retries:   3,
+		backoff:   250 * time.Millisecond,
+	}
+}
+
+// offer queues a finished query for Loki: its canonical text and latency
+func (p *lokiPusher) offer(ts time.Time, source, query string, reqtime uint64) {
+	entry := lokiEntry{
+		ts:     ts,
+		verb:   queryVerb([]byte(query)),
+		source: source,
+		line:   fmt.Sprintf("latency_ms=%.3f query=%s", float64(reqtime)/1000000, strconv.Quote(query)),
+	}
+	select {
+	case p.queue <- entry:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+// run batches and pushes queued events until the queue is closed
+func (p *lokiPusher) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	var batch []lokiEntry
+	for {
+		select {
+		case entry, ok := <-p.queue:
+			if !ok {
+				p.push(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= p.batchSize {
+				p.push(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			p.push(batch)
+			batch = nil
+		}
+	}
+}
+
+// stop pushes whatever is still queued, as at the end of a capture file
+func (p *lokiPusher) stop() {
+	close(p.queue)
+	<-p.done
+}
+
+// lokiStream is a stream in a Loki push request: its labels and
+// [timestamp in nanoseconds, line] pairs
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// push sends a batch, one stream per label set
+func (p *lokiPusher) push(batch []lokiEntry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	streams := make(map[[2]string]*lokiStream)
+	var order []*lokiStream
+	for _, e := range batch {
+		key := [2]string{e.verb, e.source}
+		s, ok := streams[key]
+		if !ok {
+			s = &lokiStream{Stream: map[string]string{
+				"job":    "mysql-sniffer",
+				"host":   p.host,
+				"verb":   e.verb,
+				"source": e.source,
+			}}
+			streams[key] = s
+			order = append(order, s)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+	}
+	body, err := json.Marshal(map[string][]*lokiStream{"streams": order})
+	if err != nil {
+		p.failed.Add(uint64(len(batch)))
+		return
+	}
+
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		err = p.post(body)
+		if err == nil {
+			p.pushed.Add(uint64(len(batch)))
+			return
+		}
+		if attempt == p.retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	p.failed.Add(uint64(len(batch)))
+	slog.Debug("loki push failed", "error", err, "events", len(batch))
+}
+
+// post makes one push request
+func (p *lokiPusher) post(body []byte) error {
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("loki returned %s", resp.Status)
+	}
+	return nil
+}
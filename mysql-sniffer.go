@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/go-mysql-org/go-mysql/client"
 	mysql "github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -132,6 +142,103 @@ type source struct {
 	reqSent    *time.Time
 	qBytes     uint64
 	qText      string
+
+	// the query in flight is a LOAD DATA LOCAL
+	loadDataLocal bool
+
+	// progress through the response to the command in flight
+	response responseMachine
+
+	// capabilities negotiated in the handshake response, if we saw it
+	capabilities uint32
+
+	// connection attributes from the handshake response
+	attrs map[string]string
+
+	// session SQL mode, as far as we've seen it set
+	sqlMode sqlMode
+
+	// session character sets, as far as we've seen them set
+	charset sessionCharset
+
+	// authentication exchange, if we saw it start
+	auth authState
+
+	// TCP sequence tracking for each direction, to spot retransmissions
+	reqSeq      seqTracker
+	respSeq     seqTracker
+	retransmits uint64
+
+	// we saw the connection open, and (with -strict-sync) gave up on it
+	sawSYN  bool
+	skipped bool
+
+	// the request in flight is counted in stats.inFlight
+	inFlight bool
+
+	// with -by-affected-rows, the canonical text of the write in flight
+	writeShape string
+
+	// with -loki, the canonical text of the query in flight
+	lokiQuery string
+
+	// canonical text of the statements prepared on this connection, by
+	// statement ID, and of the COM_STMT_PREPARE waiting for its ID
+	preparedStmts map[uint32]string
+	preparing     string
+
+	// with -by-prepared, the canonical text of the execute in flight
+	executing string
+
+	// bytes of COM_STMT_SEND_LONG_DATA the server holds for each statement
+	// until it's executed, reset or closed
+	longData map[uint32]uint64
+
+	// the client asked for the binlog; the server streams events from here on
+	replica bool
+}
+
+// resetSession forgets the session state we track for a connection, as the
+// server does on COM_RESET_CONNECTION or COM_CHANGE_USER
+func (rs *source) resetSession() {
+	rs.sqlMode = sqlMode{}
+	rs.charset = sessionCharset{}
+	rs.preparedStmts = nil
+	rs.longData = nil
+}
+
+// validated reports whether a stream meets the -strict-sync bar: seen from
+// its SYN, through a successful authentication, with no sequence gaps
+func (rs *source) validated() bool {
+	return rs.sawSYN && rs.auth.phase == authDone && !rs.reqSeq.gap && !rs.respSeq.gap
+}
+
+// failedValidation reports whether a stream can no longer become validated
+func (rs *source) failedValidation() bool {
+	return !rs.sawSYN || rs.auth.phase == authFailed || rs.reqSeq.gap || rs.respSeq.gap
+}
+
+// connectAttr returns a connection attribute of a stream, with placeholders
+// for streams whose handshake we missed or that didn't send the attribute
+func connectAttr(rs *source, name string) string {
+	if rs.attrs == nil {
+		return "(unknown)"
+	}
+	if value, ok := rs.attrs[name]; ok {
+		return value
+	}
+	return "(unset)"
+}
+
+// skipUnvalidated gives up on a stream under -strict-sync
+func skipUnvalidated(rs *source) {
+	if !rs.skipped {
+		rs.skipped = true
+		stats.skippedUnvalidated++
+		slog.Debug("skipping unvalidated stream", "src", rs.hostPort)
+	}
+	rs.reqBuffer = nil
+	rs.respBuffer = nil
 }
 
 var chmap map[string]*source = make(map[string]*source)
@@ -141,223 +248,1370 @@ var dirty bool = false
 var showRows bool = false
 var format []any
 var port uint16
+var anonymizeIPs bool = false
+var countOnly bool = false
+var prettyPrint bool = false
+var verbCounts map[string]uint64 = make(map[string]uint64)
+var maxBufferSize int = 64 << 20
+var keepBooleans bool = false
+var normalizeOperators bool = false
+var ignoreOrdering bool = false
+var emitNew bool = false
+var seenQueries map[string]bool = make(map[string]bool)
+var emitOut io.Writer = os.Stdout
+var slowThreshold time.Duration
+var strictSync bool = false
+var lockingOnly bool = false
+var adminOnly bool = false
+var noAdmin bool = false
+var adminCounts map[string]uint64 = make(map[string]uint64)
+var attrGroupBy string
+var attrCounts map[string]uint64 = make(map[string]uint64)
+var attrLatency map[string]uint64 = make(map[string]uint64)
+var attrTimed map[string]uint64 = make(map[string]uint64)
+var byProcedure bool = false
+var procedureCounts map[string]uint64 = make(map[string]uint64)
+var byAffectedRows bool = false
+var byWhereColumns bool = false
+var whereColumnCounts map[string]uint64 = make(map[string]uint64)
+var affectedRows map[string]uint64 = make(map[string]uint64)
+var maxColumnsDisplayed int = 0
+var maxValueWidth int = 0
+var displayTZ *time.Location = nil
+var sessionTZ *time.Location = time.UTC
+var hexdumpUnrecognized bool = false
+var rejectControlBytes bool = false
+var start time.Time
+var offline bool = false
+var lastPacketTime time.Time
+
+// reads and writes as of the previous status update, and the ratio between
+// them over the interval before that, to show which way the ratio is moving
+var rwLast struct {
+	reads, writes uint64
+	ratio         string
+}
 
 var stats struct {
 	packets struct {
 		rcvd      uint64
 		rcvd_sync uint64
 	}
-	desyncs uint64
-	streams uint64
+	desyncs     uint64
+	streams     uint64
+	queries     uint64
+	retransmits uint64
+
+	cartesianJoins      uint64
+	slowQueries         uint64
+	localInfileDisabled uint64
+	skippedUnvalidated  uint64
+	lockingReads        uint64
+	duplicateBatches    uint64
+	unboundedWrites     uint64
+	reads               uint64
+	writes              uint64
+	ddl                 uint64
+	controlByteQueries  uint64
+	timeWastingQueries  uint64
+	closedIncomplete    uint64
+	createDatabases     uint64
+	stmtResets          uint64
+	dropDatabases       uint64
+	closedUnanswered    uint64
+
+	// requests sent and not yet answered, across all streams, and the most
+	// there have been at once
+	inFlight    uint64
+	maxInFlight uint64
 }
 
 func main() {
 	var lport = flag.Int("P", 3306, "MySQL port to use")
 	var eth = flag.String("i", "eth0", "Interface to sniff")
+	var pcapfile = flag.String("F", "", "Read packets from this pcap file instead of sniffing an interface")
 	var ldirty = flag.Bool("u", false, "Unsanitized -- do not canonicalize queries")
 	var doverbose = flag.Bool("v", false, "Print every query received (spammy)")
 	var nocleanquery = flag.Bool("n", false, "no clean queries")
 	var formatstr = flag.String("f", "#s:#q", "Format for output aggregation")
+	var verboserate = flag.Float64("verbose-rate", 0, "Show at most this many queries per second with -v or -sample-slow (0 for no limit)")
+	var verbosededup = flag.Duration("verbose-dedup", 0, "With -v, fold the same query repeated by a source within this window, e.g. 1s, into one line with a count")
 	var doshowrows = flag.Bool("r", false, "Show all result set rows (use with -v)")
+	var doanonymize = flag.Bool("anonymize-ips", false, "Replace client IPs with stable prefix-preserving pseudonyms")
+	var pprofaddr = flag.String("pprof", "", "Serve net/http/pprof on this address (e.g. localhost:6060)")
+	var period = flag.Int("t", 10, "Seconds between status updates")
+	var doemitnew = flag.Bool("emit-new", false, "Print each canonical query to stdout, once, the first time it's seen")
+	var shedload = flag.Int("shed-load", 0, "Count queries only while this many captured packets are waiting, until half have been handled (live capture only, at most 1000, the capture queue's size; 0 to never)")
+	var docountonly = flag.Bool("count-only", false, "Only count queries by verb; skip canonicalization and responses")
+	var wrapwidth = flag.Int("wrap-width", 0, "Wrap verbose output at this many columns (0 for the terminal width, -1 for no wrapping)")
+	var doprettyprint = flag.Bool("pretty-print", false, "Break displayed queries onto one line per major clause (use with -v)")
+	var serverportstr = flag.String("server-ports", "", "Server ports and ranges, e.g. 3306,6033-6034 (default: -P)")
+	var lowerport = flag.Bool("lower-port-server", false, "If neither port is a server port, treat the lower one as the server")
+	var lokiaddr = flag.String("loki", "", "Push each query, canonicalized with its latency, to the Grafana Loki server at this URL, e.g. http://loki:3100")
+	var replaydsn = flag.String("replay-dsn", "", "Re-execute captured queries against user:password@host:port/db (sends real queries!)")
+	var replayreadonly = flag.Bool("read-only", true, "With -replay-dsn, only replay SELECT/SHOW/DESCRIBE/EXPLAIN")
+	var replayscale = flag.Float64("replay-scale", 1.0, "With -replay-dsn, fraction of captured queries to replay (0-1]")
+	var dokeepbooleans = flag.Bool("normalize-values-keep-booleans", false, "Keep the literals 0 and 1 in canonical queries instead of replacing them with ?")
+	var donormalizeops = flag.Bool("normalize-operator-spacing", false, "Put single spaces around operators in canonical queries, so id=? and id = ? match")
+	var doignoreordering = flag.Bool("ignore-ordering", false, "Leave trailing ORDER BY and LIMIT clauses out of canonical queries, so sorted and paginated variants match")
+	var sampleslow = flag.Duration("sample-slow", 0, "Only show full detail for queries at least this slow, e.g. 200ms (implies -v for those)")
+	var maxcolumns = flag.Int("max-columns-displayed", 0, "Show at most this many columns per row with -r (0 for all)")
+	var dohexdump = flag.Bool("hexdump-unrecognized", false, "Hex dump responses that don't parse as any known packet (use with -v)")
+	var displaytz = flag.String("display-tz", "", "Show DATETIME and TIMESTAMP values from -r in this time zone, e.g. UTC or Europe/Berlin")
+	var sessiontz = flag.String("session-tz", "UTC", "With -display-tz, the time zone of the sessions whose values are converted")
+	var maxwidth = flag.Int("max-value-width", 0, "Truncate values shown with -r to this many characters (0 for no limit)")
+	var dostrictsync = flag.Bool("strict-sync", false, "Only count queries on streams seen from their SYN through auth with no lost segments")
+	var attrgroupby = flag.String("attr-group-by", "", "Count queries by this connection attribute, e.g. _client_name or program_name")
+	var dolockingonly = flag.Bool("locking-only", false, "Only report locking reads (SELECT ... FOR UPDATE / FOR SHARE / LOCK IN SHARE MODE)")
+	var doadminonly = flag.Bool("admin-only", false, "Only report administrative statements (KILL, SHOW, SET, FLUSH, ...)")
+	var donoadmin = flag.Bool("no-admin", false, "Leave administrative statements (KILL, SHOW, SET, FLUSH, ...) out")
+	var byclientversion = flag.Bool("aggregate-by-client-version", false, "Shorthand for -attr-group-by _client_version")
+	var dobyprepared = flag.Bool("by-prepared", false, "Count prepares and executes per prepared statement, flagging statements re-prepared for nearly every execute")
+	var dobyaffected = flag.Bool("by-affected-rows", false, "Total the rows each canonical write query changed, from its OK packets")
+	var dobywhere = flag.Bool("by-where-columns", false, "Count queries by the set of columns their WHERE clause filters on")
+	var dobyprocedure = flag.Bool("by-procedure", false, "Count CALL statements by stored procedure name")
+	var snapshotdir = flag.String("snapshot-dir", "", "Also write each status update to its own timestamped file in this directory")
+	var snapshotkeep = flag.Int("snapshot-keep", 0, "With -snapshot-dir, keep only this many of the most recent snapshots (0 for all)")
+	var epochmarker = flag.String("epoch-marker", "", "Regexp for marker queries that start a new named epoch, e.g. EPOCH:(\\w+)")
+	var dorejectcontrol = flag.Bool("reject-control-bytes", false, "Leave out queries containing NUL or other control bytes, counting them as suspicious")
+	var runas = flag.String("user", "", "Drop to this user once the capture is open")
+	var watchfile = flag.String("watch-file", "", "File of queries to always report on, one per line (reloaded on SIGHUP)")
+	var maxrespbuf = flag.Int("max-response-buffer", 64<<20, "Bytes to buffer per stream before giving up on it as desynced")
 	flag.Parse()
+	if *period <= 0 {
+		log.Fatalf("-t must be a positive number of seconds, got %d", *period)
+	}
 
 	verbose = *doverbose
 	noclean = *nocleanquery
 	showRows = *doshowrows
+	if *verboserate > 0 {
+		verboseLimit = newRateLimiter(*verboserate)
+	}
+	if *verbosededup > 0 {
+		verboseDedup = newVerboseDeduper(*verbosededup)
+	}
 	port = uint16(*lport)
+	serverPorts = []portRange{{port, port}}
+	if *serverportstr != "" {
+		ranges, err := parseServerPorts(*serverportstr)
+		if err != nil {
+			log.Fatalf("Invalid -server-ports: %s", err.Error())
+		}
+		serverPorts = ranges
+	}
+	lowerPortIsServer = *lowerport
 	dirty = *ldirty
+	anonymizeIPs = *doanonymize
+	countOnly = *docountonly
+	emitNew = *doemitnew
+	prettyPrint = *doprettyprint
+	wrapWidth = *wrapwidth
+	if wrapWidth == 0 {
+		wrapWidth = terminalWidth()
+	}
+	keepBooleans = *dokeepbooleans
+	normalizeOperators = *donormalizeops
+	ignoreOrdering = *doignoreordering
+	slowThreshold = *sampleslow
+	strictSync = *dostrictsync
+	lockingOnly = *dolockingonly
+	adminOnly = *doadminonly
+	noAdmin = *donoadmin
+	if adminOnly && noAdmin {
+		log.Fatalf("-admin-only and -no-admin can't be used together")
+	}
+	attrGroupBy = *attrgroupby
+	if *byclientversion {
+		if attrGroupBy != "" && attrGroupBy != "_client_version" {
+			log.Fatalf("-aggregate-by-client-version can't be used with -attr-group-by %s", attrGroupBy)
+		}
+		attrGroupBy = "_client_version"
+	}
+	byProcedure = *dobyprocedure
+	byAffectedRows = *dobyaffected
+	byPrepared = *dobyprepared
+	byWhereColumns = *dobywhere
+	if *shedload > 0 {
+		if *pcapfile != "" {
+			log.Fatalf("-shed-load only applies to live capture; a capture file never falls behind")
+		}
+		if *shedload > PACKET_QUEUE_SIZE {
+			log.Fatalf("-shed-load can be at most %d, the number of packets the capture queues", PACKET_QUEUE_SIZE)
+		}
+		shedder = newLoadShedder(*shedload)
+	}
+	if strictSync && countOnly {
+		log.Fatalf("-strict-sync needs responses to validate streams, so it can't be used with -count-only")
+	}
+	maxColumnsDisplayed = *maxcolumns
+	maxValueWidth = *maxwidth
+	if *displaytz != "" {
+		var err error
+		if displayTZ, err = time.LoadLocation(*displaytz); err != nil {
+			log.Fatalf("Invalid -display-tz: %s", err.Error())
+		}
+		if sessionTZ, err = time.LoadLocation(*sessiontz); err != nil {
+			log.Fatalf("Invalid -session-tz: %s", err.Error())
+		}
+	}
+	hexdumpUnrecognized = *dohexdump
+	rejectControlBytes = *dorejectcontrol
+	if *maxrespbuf <= 0 {
+		log.Fatalf("-max-response-buffer must be positive, got %d", *maxrespbuf)
+	}
+	maxBufferSize = *maxrespbuf
+	snapshotDir = *snapshotdir
+	snapshotKeep = *snapshotkeep
 	parseFormat(*formatstr)
 
-	log.Printf("Initializing MySQL sniffing on %s:%d...", *eth, port)
-	handle, err := pcap.OpenLive(*eth, 1024*1024, false, pcap.BlockForever)
-	if err != nil {
-		log.Fatalf("Failed to open device: %s", err.Error())
+	if *epochmarker != "" {
+		marker, err := regexp.Compile(*epochmarker)
+		if err != nil {
+			log.Fatalf("Invalid -epoch-marker: %s", err.Error())
+		}
+		epochs = newEpochTracker(marker)
+	}
+
+	if *watchfile != "" {
+		w, err := loadWatchList(*watchfile, nil)
+		if err != nil {
+			log.Fatalf("Failed to load watch file: %s", err.Error())
+		}
+		watch = w
+		log.Printf("Watching %d queries from %s", len(watch.queries), *watchfile)
+	}
+
+	if *pprofaddr != "" {
+		addr, err := startPprof(*pprofaddr)
+		if err != nil {
+			log.Fatalf("Failed to start pprof: %s", err.Error())
+		}
+		log.Printf("Serving pprof on http://%s/debug/pprof/", addr)
+	}
+
+	if *replaydsn != "" {
+		if *replayscale <= 0 || *replayscale > 1 {
+			log.Fatalf("-replay-scale must be in (0, 1], got %g", *replayscale)
+		}
+		addr, user, password, dbName, err := parseReplayDSN(*replaydsn)
+		if err != nil {
+			log.Fatalf("Invalid replay DSN: %s", err.Error())
+		}
+		conn, err := client.Connect(addr, user, password, dbName)
+		if err != nil {
+			log.Fatalf("Failed to connect to replay target: %s", err.Error())
+		}
+		defer conn.Close()
+
+		log.Printf("%sWARNING: replaying captured queries against %s -- these are real queries!%s",
+			COLOR_RED, addr, COLOR_DEFAULT)
+		if !*replayreadonly {
+			log.Printf("%sWARNING: -read-only=false, writes and DDL will be replayed too%s", COLOR_RED, COLOR_DEFAULT)
+		}
+		replay = newReplayer(&mysqlExecutor{conn: conn}, *replayreadonly, *replayscale)
+		go replay.run()
+	}
+
+	if *lokiaddr != "" {
+		host, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Failed to get the hostname for -loki: %s", err.Error())
+		}
+		loki = newLokiPusher(*lokiaddr, host)
+		go loki.run()
+	}
+
+	var handle *pcap.Handle
+	var err error
+	if *pcapfile != "" {
+		log.Printf("Reading MySQL traffic from %s (%s)...", *pcapfile, captureFilter())
+		offline = true
+		handle, err = pcap.OpenOffline(*pcapfile)
+		if err != nil {
+			log.Fatalf("Failed to open capture file: %s", err.Error())
+		}
+	} else {
+		log.Printf("Initializing MySQL sniffing on %s (%s)...", *eth, captureFilter())
+		handle, err = pcap.OpenLive(*eth, 1024*1024, false, pcap.BlockForever)
+		if err != nil {
+			log.Fatalf("Failed to open device: %s", err.Error())
+		}
+	}
+	defer handle.Close()
+
+	err = handle.SetBPFFilter(captureFilter())
+	if err != nil {
+		log.Fatalf("Failed to set port filter: %s", err.Error())
+	}
+
+	if *runas != "" {
+		if err := dropPrivileges(*runas); err != nil {
+			log.Fatalf("Failed to drop privileges to %s: %s", *runas, err.Error())
+		}
+		log.Printf("Dropped privileges to %s", *runas)
+	}
+
+	// Created as the user we run as, so snapshots can be written into it
+	if snapshotDir != "" {
+		if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
+			log.Fatalf("Failed to create snapshot directory: %s", err.Error())
+		}
+	}
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packets := packetSource.Packets()
+	if shedder != nil && cap(packets) < shedder.highWater {
+		log.Fatalf("-shed-load %d can never trigger: the capture queues only %d packets", shedder.highWater, cap(packets))
+	}
+	ticker := time.NewTicker(time.Duration(*period) * time.Second)
+	defer ticker.Stop()
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	if !offline {
+		start = time.Now()
+	}
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				if verboseDedup != nil {
+					verboseDedup.flush(time.Time{})
+				}
+				if replay != nil {
+					replay.stop()
+				}
+				if loki != nil {
+					loki.stop()
+				}
+				reportStatus(statusTime())
+				return
+			}
+			if offline && start.IsZero() {
+				start = packet.Metadata().Timestamp
+			}
+			if shedder != nil {
+				checkBacklog(len(packets), time.Now())
+			}
+			handlePacket(packet)
+		case <-ticker.C:
+			if verboseDedup != nil {
+				verboseDedup.flush(statusTime())
+			}
+			reportStatus(statusTime())
+		case <-hangup:
+			if watch == nil {
+				continue
+			}
+			w, err := loadWatchList(watch.path, watch)
+			if err != nil {
+				log.Printf("Failed to reload watch file, keeping the old list: %s", err.Error())
+				continue
+			}
+			watch = w
+			log.Printf("Reloaded %d watched queries from %s", len(watch.queries), watch.path)
+		}
+	}
+}
+
+// perSecond is a rate over elapsed seconds, or 0 before any time has passed
+// (a status update right at startup, or a capture file of a single packet)
+func perSecond(count uint64, elapsed float64) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) / elapsed
+}
+
+// syncedPercent is the share of packets received on synced streams
+func syncedPercent() float64 {
+	if stats.packets.rcvd == 0 {
+		return 0
+	}
+	return float64(stats.packets.rcvd_sync) / float64(stats.packets.rcvd) * 100
+}
+
+// statusTime is when a status update is as of: now, or the time of the last
+// packet read from a capture file
+func statusTime() time.Time {
+	if offline {
+		return lastPacketTime
+	}
+	return time.Now()
+}
+
+// handleStatusUpdate prints the periodic status report
+func handleStatusUpdate() {
+	// Rates in a capture file are over the time it covers
+	elapsed := time.Since(start).Seconds()
+	if offline {
+		elapsed = lastPacketTime.Sub(start).Seconds()
+	}
+
+	log.Printf("%s%d total queries, %0.2f per second%s", COLOR_RED, stats.queries,
+		perSecond(stats.queries, elapsed), COLOR_DEFAULT)
+	log.Printf("%d packets (%0.2f%% synced), %d desyncs, %d retransmits, %d streams",
+		stats.packets.rcvd, syncedPercent(),
+		stats.desyncs, stats.retransmits, stats.streams)
+	if stats.reads+stats.writes+stats.ddl > 0 {
+		interval := readWriteRatio(stats.reads-rwLast.reads, stats.writes-rwLast.writes)
+		trend := ""
+		if rwLast.ratio != "" {
+			trend = fmt.Sprintf(", was %s", rwLast.ratio)
+		}
+		log.Printf("%d reads, %d writes, %d DDL: %s reads per write (%s this interval%s)",
+			stats.reads, stats.writes, stats.ddl, readWriteRatio(stats.reads, stats.writes), interval, trend)
+		rwLast.reads, rwLast.writes, rwLast.ratio = stats.reads, stats.writes, interval
+	}
+	if verboseLimit != nil && verboseLimit.suppressed > 0 {
+		log.Printf("%d query displays suppressed by -verbose-rate", verboseLimit.suppressed)
+		verboseLimit.suppressed = 0
+	}
+	if stats.maxInFlight > 0 {
+		log.Printf("%d requests in flight (peak %d)", stats.inFlight, stats.maxInFlight)
+	}
+	if replay != nil {
+		log.Printf("Replay: %d replayed, %d failed, %d skipped by -read-only, %d dropped",
+			replay.replayed.Load(), replay.failed.Load(), replay.skipped.Load(), replay.dropped.Load())
+	}
+	if loki != nil {
+		log.Printf("Loki: %d pushed, %d failed, %d dropped", loki.pushed.Load(), loki.failed.Load(), loki.dropped.Load())
+	}
+	if slowThreshold > 0 {
+		log.Printf("%d queries slower than %s", stats.slowQueries, slowThreshold)
+	}
+	if strictSync {
+		log.Printf("%d streams skipped as unvalidated by -strict-sync", stats.skippedUnvalidated)
+	}
+	if stats.localInfileDisabled > 0 {
+		log.Printf("%s%d LOAD DATA LOCAL attempts refused by local_infile=0%s", COLOR_YELLOW, stats.localInfileDisabled, COLOR_DEFAULT)
+	}
+	if stats.lockingReads > 0 {
+		log.Printf("%d locking reads", stats.lockingReads)
+	}
+	if len(adminCounts) > 0 {
+		verbs := make([]string, 0, len(adminCounts))
+		for verb := range adminCounts {
+			verbs = append(verbs, verb)
+		}
+		sort.Strings(verbs)
+		parts := make([]string, 0, len(verbs))
+		for _, verb := range verbs {
+			parts = append(parts, fmt.Sprintf("%s %d", verb, adminCounts[verb]))
+		}
+		log.Printf("Admin statements: %s", strings.Join(parts, ", "))
+	}
+	if stats.unboundedWrites > 0 {
+		log.Printf("%s%d UPDATE/DELETE statements without a WHERE clause%s", COLOR_RED, stats.unboundedWrites, COLOR_DEFAULT)
+	}
+	if stats.stmtResets > 0 {
+		log.Printf("%d COM_STMT_RESET", stats.stmtResets)
+	}
+	if stats.createDatabases > 0 || stats.dropDatabases > 0 {
+		log.Printf("%s%d COM_CREATE_DB, %d COM_DROP_DB%s", COLOR_RED, stats.createDatabases, stats.dropDatabases, COLOR_DEFAULT)
+	}
+	if stats.closedIncomplete > 0 {
+		log.Printf("%s%d responses cut off by the connection closing%s", COLOR_YELLOW, stats.closedIncomplete, COLOR_DEFAULT)
+	}
+	if stats.closedUnanswered > 0 {
+		log.Printf("%s%d requests unanswered when the connection closed%s", COLOR_YELLOW, stats.closedUnanswered, COLOR_DEFAULT)
+	}
+	if stats.timeWastingQueries > 0 {
+		log.Printf("%s%d queries called SLEEP() or BENCHMARK()%s", COLOR_RED, stats.timeWastingQueries, COLOR_DEFAULT)
+	}
+	if stats.controlByteQueries > 0 {
+		log.Printf("%s%d queries with control bytes left out by -reject-control-bytes%s", COLOR_YELLOW, stats.controlByteQueries, COLOR_DEFAULT)
+	}
+	if stats.duplicateBatches > 0 {
+		log.Printf("%s%d multi-statement queries repeated a statement%s", COLOR_YELLOW, stats.duplicateBatches, COLOR_DEFAULT)
+	}
+	if stats.cartesianJoins > 0 {
+		log.Printf("%s%d queries joined tables without a join condition%s", COLOR_YELLOW, stats.cartesianJoins, COLOR_DEFAULT)
+	}
+
+	if watch != nil {
+		watch.report()
+	}
+
+	if epochs != nil {
+		epochs.report()
+	}
+
+	if attrGroupBy != "" {
+		values := make([]string, 0, len(attrCounts))
+		for value := range attrCounts {
+			values = append(values, value)
+		}
+		sort.Slice(values, func(i, j int) bool {
+			if attrCounts[values[i]] != attrCounts[values[j]] {
+				return attrCounts[values[i]] > attrCounts[values[j]]
+			}
+			return values[i] < values[j]
+		})
+		log.Printf("Queries by %s:", attrGroupBy)
+		for _, value := range values {
+			avg := "-"
+			if attrTimed[value] > 0 {
+				avg = fmt.Sprintf("%.2fms", float64(attrLatency[value])/float64(attrTimed[value])/1000000)
+			}
+			log.Printf("%8d %10.2f/s %10s avg  %s", attrCounts[value], perSecond(attrCounts[value], elapsed), avg, value)
+		}
+	}
+
+	if byProcedure && len(procedureCounts) > 0 {
+		names := make([]string, 0, len(procedureCounts))
+		for name := range procedureCounts {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if procedureCounts[names[i]] != procedureCounts[names[j]] {
+				return procedureCounts[names[i]] > procedureCounts[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		log.Printf("Procedure calls:")
+		for _, name := range names {
+			log.Printf("%8d %10.2f/s  %s", procedureCounts[name], perSecond(procedureCounts[name], elapsed), name)
+		}
+	}
+
+	if byWhereColumns && len(whereColumnCounts) > 0 {
+		signatures := make([]string, 0, len(whereColumnCounts))
+		for signature := range whereColumnCounts {
+			signatures = append(signatures, signature)
+		}
+		sort.Slice(signatures, func(i, j int) bool {
+			if whereColumnCounts[signatures[i]] != whereColumnCounts[signatures[j]] {
+				return whereColumnCounts[signatures[i]] > whereColumnCounts[signatures[j]]
+			}
+			return signatures[i] < signatures[j]
+		})
+		log.Printf("Queries by WHERE columns:")
+		for _, signature := range signatures {
+			log.Printf("%8d %10.2f/s  %s", whereColumnCounts[signature], perSecond(whereColumnCounts[signature], elapsed), escapeControlBytes(signature))
+		}
+	}
+
+	if byAffectedRows && len(affectedRows) > 0 {
+		shapes := make([]string, 0, len(affectedRows))
+		for shape := range affectedRows {
+			shapes = append(shapes, shape)
+		}
+		sort.Slice(shapes, func(i, j int) bool {
+			if affectedRows[shapes[i]] != affectedRows[shapes[j]] {
+				return affectedRows[shapes[i]] > affectedRows[shapes[j]]
+			}
+			return shapes[i] < shapes[j]
+		})
+		log.Printf("Rows changed by write:")
+		for _, shape := range shapes {
+			log.Printf("%12d  %s", affectedRows[shape], escapeControlBytes(shape))
+		}
+	}
+
+	if byPrepared && len(preparedShapes) > 0 {
+		reportPreparedShapes()
+	}
+
+	if len(replicas) > 0 {
+		reportReplicas()
+	}
+
+	if shedder != nil && shedder.degradedFor(statusTime()) > 0 {
+		log.Printf("%sCounted queries only for %s to keep up with the capture, %d time(s)%s", COLOR_YELLOW,
+			shedder.degradedFor(statusTime()).Round(time.Millisecond), shedder.stretches, COLOR_DEFAULT)
+	}
+
+	if len(verbCounts) > 0 {
+		if !countOnly {
+			log.Printf("Queries counted under -shed-load:")
+		}
+		verbs := make([]string, 0, len(verbCounts))
+		for verb := range verbCounts {
+			verbs = append(verbs, verb)
+		}
+		sort.Slice(verbs, func(i, j int) bool {
+			if verbCounts[verbs[i]] != verbCounts[verbs[j]] {
+				return verbCounts[verbs[i]] > verbCounts[verbs[j]]
+			}
+			return verbs[i] < verbs[j]
+		})
+		for _, verb := range verbs {
+			log.Printf("%8d %10.2f/s  %s", verbCounts[verb], perSecond(verbCounts[verb], elapsed), verb)
+		}
+	}
+}
+
+// extract the data using structured packet parsing with gopacket
+func handlePacket(packet gopacket.Packet) {
+	// Large queries can arrive as IP fragments; wait for the whole datagram
+	packet, ok := defragment(packet)
+	if !ok {
+		return
+	}
+
+	// Parse network layer to get IP addresses
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return
+	}
+
+	// Parse transport layer to get TCP ports
+	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return
+	}
+	tcp, _ := tcpLayer.(*layers.TCP)
+
+	// Get IP layer for addresses
+	var srcIP, dstIP string
+	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
+		ipv4, _ := ipv4Layer.(*layers.IPv4)
+		srcIP = ipv4.SrcIP.String()
+		dstIP = ipv4.DstIP.String()
+	} else if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
+		ipv6, _ := ipv6Layer.(*layers.IPv6)
+		srcIP = ipv6.SrcIP.String()
+		dstIP = ipv6.DstIP.String()
+	} else {
+		return
+	}
+
+	// Extract ports
+	srcPort := uint16(tcp.SrcPort)
+	dstPort := uint16(tcp.DstPort)
+
+	// Get application layer payload
+	var payload []byte
+	if applicationLayer := packet.ApplicationLayer(); applicationLayer != nil {
+		payload = applicationLayer.Payload()
+	}
+
+	// If this is a 0-length payload, do nothing, unless it's opening or
+	// closing a connection.
+	if len(payload) <= 0 && !tcp.SYN && !tcp.FIN && !tcp.RST {
+		return
+	}
+
+	// This is either an inbound or outbound packet. Determine by seeing which
+	// end is the server. Either way, we want to put this on the channel of
+	// the remote end.
+	request, ok := packetDirection(srcPort, dstPort)
+	if !ok {
+		slog.Debug("can't tell packet direction, dropping", "srcPort", srcPort, "dstPort", dstPort)
+		return
+	}
+	// IPv6 addresses are bracketed, [::1]:51000
+	var src string
+	if request {
+		src = net.JoinHostPort(srcIP, fmt.Sprint(srcPort))
+	} else {
+		src = net.JoinHostPort(dstIP, fmt.Sprint(dstPort))
+	}
+
+	// Get the data structure for this source, then do something.
+	rs, ok := chmap[src]
+	if !ok {
+		// Nothing to close on a stream we never saw
+		if len(payload) <= 0 && !tcp.SYN {
+			return
+		}
+		srcIP, clientPort, _ := net.SplitHostPort(src)
+		hostPort := src
+		if anonymizeIPs {
+			// Only the displayed address is replaced; the stream map stays
+			// keyed on the real address.
+			srcIP = anonymizeIP(srcIP)
+			hostPort = net.JoinHostPort(srcIP, clientPort)
+		}
+		rs = &source{hostPort: hostPort, srcIP: srcIP, synced: false}
+		stats.streams++
+		chmap[src] = rs
+	}
+
+	// A connection starting; whatever we knew about an earlier one on the
+	// same address is stale. The SYN takes up one sequence number.
+	if tcp.SYN {
+		if request && !tcp.ACK {
+			finishRequest(rs)
+			*rs = source{hostPort: rs.hostPort, srcIP: rs.srcIP, sawSYN: true}
+			rs.reqSeq = seqTracker{next: tcp.Seq + 1, valid: true}
+		} else if !request && rs.sawSYN {
+			rs.respSeq = seqTracker{next: tcp.Seq + 1, valid: true}
+		}
+		return
+	}
+
+	// A bare FIN or RST; one carrying data closes once the data is handled
+	if len(payload) <= 0 {
+		closeStream(rs)
+		return
+	}
+
+	// A retransmitted segment carries data we've already processed; only
+	// the part we haven't seen yet (if any) goes on.
+	seq := &rs.respSeq
+	if request {
+		seq = &rs.reqSeq
+	}
+	payload, retransmit := seq.accept(tcp.Seq, payload)
+	if retransmit {
+		rs.retransmits++
+		stats.retransmits++
+		slog.Debug("retransmitted segment", "src", rs.hostPort, "seq", tcp.Seq, "new", len(payload))
+		if len(payload) == 0 {
+			return
+		}
+	}
+
+	if request {
+		slog.Info("request", "src", rs.hostPort)
+	} else {
+		slog.Info("response", "src", rs.hostPort)
+	}
+
+	// Now with a source, process the packet.
+	// Time the query by when its packets were captured, not by when we got
+	// round to them; that matters most when reading a capture file.
+	ts := packet.Metadata().Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if ts.After(lastPacketTime) {
+		lastPacketTime = ts
+	}
+	processPacket(rs, request, payload, ts)
+	if tcp.FIN || tcp.RST {
+		closeStream(rs)
+	}
+}
+
+// processPacket dispatches packet processing to request or response handler
+func processPacket(rs *source, request bool, data []byte, ts time.Time) {
+	stats.packets.rcvd++
+	if rs.synced {
+		stats.packets.rcvd_sync++
+	}
+
+	if strictSync && (rs.skipped || rs.failedValidation()) {
+		skipUnvalidated(rs)
+		return
+	}
+
+	// Count-only mode never looks at responses, and only looks at requests
+	// far enough to find the verb. -shed-load falls back to it under load.
+	if countOnly || (shedder != nil && shedder.degraded) {
+		if request {
+			countRequest(data)
+		}
+		return
+	}
+
+	if request {
+		processRequest(rs, data, ts)
+	} else {
+		processResponse(rs, data, ts)
+	}
+}
+
+// countRequest carves every packet out of a request and counts each COM_QUERY
+// under its leading keyword, without canonicalizing it
+func countRequest(data []byte) {
+	buf := data
+	for {
+		pType, pData, err := carvePacket(&buf)
+		if errors.Is(err, errEmptyPacket) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if pType != CommandType(mysql.COM_QUERY) {
+			continue
+		}
+
+		query, err := parseComQuery(pData)
+		if err != nil {
+			continue
+		}
+		stats.queries++
+		verbCounts[queryVerb(query)]++
+	}
+}
+
+// processRequest handles MySQL request packets (queries from client to server)
+func processRequest(rs *source, data []byte, ts time.Time) {
+	slog.Info("receive request", "hostPort", rs.hostPort, "dataLength", len(data))
+
+	// After a LOCAL INFILE request the client sends the file, not commands
+	if rs.reqSent != nil && rs.response.state == respLocalInfile {
+		data = consumeLocalInfile(rs, data)
+		if len(data) == 0 {
+			return
+		}
+	}
+
+	// If we still have response data, we're in some weird state and
+	// didn't successfully process the response. The exception is the
+	// server's greeting, which nothing consumes: the client's handshake
+	// response to it is how a connection should start.
+	if len(rs.respBuffer) > 0 {
+		if rs.synced || !isHandshakeResponse(data) {
+			stats.desyncs++
+		}
+		rs.respBuffer = nil
+		rs.synced = false
+	}
+
+	// A segment can carry several packets (or the rest of a packet started
+	// in the previous segment), so process every complete packet and keep
+	// any trailing partial one for next time.
+	rs.reqBuffer = append(rs.reqBuffer, data...)
+	if len(rs.reqBuffer) > maxBufferSize {
+		slog.Debug("request buffer over limit, dropping", "hostPort", rs.hostPort, "size", len(rs.reqBuffer))
+		desyncSource(rs)
+		return
+	}
+	for {
+		pType, pData, err := carvePacket(&rs.reqBuffer)
+		if errors.Is(err, errEmptyPacket) {
+			continue
+		}
+		if errors.Is(err, errChunkSequence) {
+			slog.Debug("lost the request framing", "hostPort", rs.hostPort, "error", err)
+			desyncSource(rs)
+			return
+		}
+
+		// Handle packet parsing errors (incomplete or malformed packets)
+		if err != nil {
+			slog.Debug("failed to parse packet", "error", err)
+			break
+		}
+
+		processCommand(rs, pType, pData, ts)
+	}
+
+	// Until we're synced we can't trust the packet framing, so leftovers
+	// aren't worth carrying into the next segment.
+	if !rs.synced {
+		rs.reqBuffer = nil
+	}
+}
+
+// processCommand handles a single command packet carved from a request
+func processCommand(rs *source, pType CommandType, pData []byte, ts time.Time) {
+	// Until the server's final OK, whatever the client sends is auth data
+	// (a plugin's reply, a public key request, a password), not a command.
+	if rs.auth.phase == authPending {
+		return
+	}
+
+	// COM_CHANGE_USER runs the authentication exchange all over again
+	if rs.synced && pType == CommandType(mysql.COM_CHANGE_USER) {
+		rs.resetSession()
+		rs.auth.start("")
+		return
+	}
+
+	// COM_RESET_CONNECTION keeps the connection but not its session state;
+	// it's otherwise an ordinary command answered with an OK.
+	if pType == CommandType(mysql.COM_RESET_CONNECTION) {
+		rs.resetSession()
+	}
+
+	// The synchronization logic: if we're not synced, we wait for a COM_QUERY
+	if !rs.synced {
+		// The handshake response comes before any command; remember the
+		// capabilities it negotiated since they change response framing.
+		if hs, ok := parseHandshakeResponse(append([]byte{byte(pType)}, pData...)); ok {
+			rs.capabilities = hs.capabilities
+			rs.attrs = hs.attrs
+			if verbose && len(hs.attrs) > 0 {
+				slog.Info("connection attributes", "src", rs.hostPort, "attrs", hs.attrs)
+			}
+			if !hs.sslRequest {
+				rs.auth.start(hs.plugin)
+			}
+			rs.respBuffer = nil
+			return
+		}
+
+		if pType != CommandType(mysql.COM_QUERY) {
+			rs.respBuffer = nil
+			return
+		}
+		rs.synced = true
+	}
+
+	// Under -strict-sync nothing counts until the stream has proven itself
+	if strictSync && !rs.validated() {
+		skipUnvalidated(rs)
+		return
+	}
+
+	// A replica's binlog dump is answered by an endless stream of events
+	// rather than a response, so it's recorded but never timed
+	if pType == CommandType(mysql.COM_BINLOG_DUMP) || pType == CommandType(mysql.COM_BINLOG_DUMP_GTID) {
+		recordBinlogDump(rs, pType, pData)
+		return
+	}
+
+	if pType == CommandType(mysql.COM_CREATE_DB) || pType == CommandType(mysql.COM_DROP_DB) {
+		recordSchemaCommand(rs, pType, pData)
+	}
+
+	// The server replies to a COM_STMT_PREPARE with the statement's ID
+	rs.preparing, rs.executing = "", ""
+	switch byte(pType) {
+	case mysql.COM_STMT_PREPARE:
+		rs.preparing = cleanupQueryWithMode(pData, rs.sqlMode)
+	case mysql.COM_STMT_CLOSE:
+		if len(pData) >= 4 {
+			delete(rs.preparedStmts, binary.LittleEndian.Uint32(pData[0:4]))
+			delete(rs.longData, binary.LittleEndian.Uint32(pData[0:4]))
+		}
+	case mysql.COM_STMT_SEND_LONG_DATA:
+		// statement ID (4), parameter (2), then a piece of the value
+		if len(pData) >= 6 {
+			if rs.longData == nil {
+				rs.longData = make(map[uint32]uint64)
+			}
+			rs.longData[binary.LittleEndian.Uint32(pData[0:4])] += uint64(len(pData) - 6)
+		}
+	case mysql.COM_STMT_RESET, mysql.COM_STMT_EXECUTE:
+		// An execute sends the long data along; a reset throws it away
+		if len(pData) >= 4 {
+			delete(rs.longData, binary.LittleEndian.Uint32(pData[0:4]))
+		}
+		if byte(pType) == mysql.COM_STMT_RESET {
+			stats.stmtResets++
+		}
+	}
+
+	// Parse COM_QUERY data to extract actual SQL query text
+	// This handles both legacy format and MySQL 8.0.23+ query attributes
+	var parsedQuery []byte
+	var tags queryTags
+	reported := true
+	if pType == CommandType(mysql.COM_QUERY) {
+		var err error
+		parsedQuery, err = parseComQuery(pData)
+		if err != nil {
+			slog.Debug("failed to parse COM_QUERY", "error", err)
+			return
+		}
+
+		// Queries the filters leave out are still paired with their
+		// responses but otherwise ignored
+		tags = tagQuery(parsedQuery)
+		reported = tags.reported()
+		rs.writeShape, rs.lokiQuery = "", ""
+		if rejectControlBytes && hasControlBytes(parsedQuery) {
+			stats.controlByteQueries++
+			slog.Warn("suspicious query contains control bytes", "src", rs.hostPort, "query", escapeControlBytes(string(parsedQuery)))
+			reported = false
+		}
+		if reported {
+			recordQuery(rs, parsedQuery, tags)
+		}
+
+		rs.loadDataLocal = isLoadDataLocal(parsedQuery)
+	} else if pType == CommandType(mysql.COM_STMT_EXECUTE) {
+		// Executes carry the statement ID and bound values, not the SQL
+		var known bool
+		parsedQuery, known = executedStatement(rs, pData)
+		if byPrepared && known {
+			preparedShapeFor(string(parsedQuery)).executes++
+			rs.executing = string(parsedQuery)
+		}
+		rs.writeShape, rs.lokiQuery = "", ""
+		rs.loadDataLocal = false
+	} else {
+		// For non-COM_QUERY commands, use data as-is
+		parsedQuery = pData
+		rs.writeShape, rs.lokiQuery = "", ""
+		rs.loadDataLocal = false
+	}
+
+	// Record request timestamp
+	startRequest(rs, pType, ts)
+	rs.response = responseMachine{prepare: pType == CommandType(mysql.COM_STMT_PREPARE)}
+
+	// Format the query text according to user preferences, made safe to
+	// print; only what's displayed is escaped
+	text := escapeControlBytes(decodeCharset(rs.charset.client, formatQueryText(rs, parsedQuery)))
+
+	// A SET sql_mode changes how later queries on this session tokenize, and
+	// a SET NAMES how its queries and results are encoded
+	if pType == CommandType(mysql.COM_QUERY) {
+		if mode, ok := parseSQLModeSet(parsedQuery, rs.sqlMode); ok {
+			rs.sqlMode = mode
+		}
+		if charset, ok := parseCharsetSet(parsedQuery, rs.sqlMode, rs.charset); ok {
+			rs.charset = charset
+		}
+	}
+
+	if tags.locking {
+		text += fmt.Sprintf(" %s[locking read]%s", COLOR_YELLOW, COLOR_DEFAULT)
+	}
+	if tags.admin {
+		text += fmt.Sprintf(" %s[admin]%s", COLOR_CYAN, COLOR_DEFAULT)
+	}
+	if !reported {
+		text = ""
+	}
+
+	// Store query text and bytes for display
+	rs.qText = text
+	rs.qBytes = uint64(len(pData))
+}
+
+// queryTags are the categories a query falls into
+type queryTags struct {
+	locking bool // SELECT ... FOR UPDATE and friends
+	admin   bool // KILL, SHOW, SET, FLUSH and other administrative statements
+}
+
+// tagQuery works out which categories a query falls into
+func tagQuery(query []byte) queryTags {
+	return queryTags{locking: isLockingRead(query), admin: isAdminQuery(query)}
+}
+
+// reported applies -locking-only, -admin-only and -no-admin
+func (t queryTags) reported() bool {
+	switch {
+	case lockingOnly && !t.locking:
+		return false
+	case adminOnly && !t.admin:
+		return false
+	case noAdmin && t.admin:
+		return false
+	}
+	return true
+}
+
+// recordQuery counts a COM_QUERY and feeds it to everything watching the
+// query stream: replay, the watch list and the query checks
+func recordQuery(rs *source, query []byte, tags queryTags) {
+	// Epoch markers only divide up the workload; they aren't part of it
+	if epochs != nil && epochs.mark(query) {
+		return
+	}
+
+	stats.queries++
+	switch queryClass(query) {
+	case CLASS_READ:
+		stats.reads++
+	case CLASS_WRITE:
+		stats.writes++
+	case CLASS_DDL:
+		stats.ddl++
+	}
+	if epochs != nil {
+		epochs.count(query)
+	}
+	if tags.locking {
+		stats.lockingReads++
+	}
+	if tags.admin {
+		adminCounts[queryVerb(query)]++
+	}
+	if attrGroupBy != "" {
+		attrCounts[connectAttr(rs, attrGroupBy)]++
+	}
+	if loki != nil {
+		rs.lokiQuery = escapeControlBytes(cleanupQueryWithMode(query, rs.sqlMode))
+	}
+	if byAffectedRows && queryClass(query) == CLASS_WRITE {
+		rs.writeShape = cleanupQueryWithMode(query, rs.sqlMode)
+	}
+	if byWhereColumns {
+		if signature := whereSignature(query); signature != "" {
+			whereColumnCounts[signature]++
+		}
+	}
+	if byProcedure {
+		if name := callProcedureName(query); name != "" {
+			procedureCounts[name]++
+		}
+	}
+
+	if replay != nil {
+		replay.offer(string(query))
+	}
+
+	// Just the query on a line of its own, for piping into a file
+	if emitNew {
+		if canonical := escapeControlBytes(cleanupQueryWithMode(query, rs.sqlMode)); !seenQueries[canonical] {
+			seenQueries[canonical] = true
+			fmt.Fprintln(emitOut, canonical)
+		}
+	}
+
+	if watch != nil {
+		if canonical := cleanupQueryWithMode(query, rs.sqlMode); watch.observe(canonical) {
+			log.Printf("%sWatched query from %s: %s%s", COLOR_YELLOW, rs.hostPort, escapeControlBytes(canonical), COLOR_DEFAULT)
+		}
+	}
+
+	if dups := duplicateStatements(query, rs.sqlMode); len(dups) > 0 {
+		stats.duplicateBatches++
+		for canonical, n := range dups {
+			slog.Warn("multi-statement query repeats a statement", "src", rs.hostPort, "times", n, "statement", canonical)
+		}
+	}
+
+	if isUnboundedWrite(query) {
+		stats.unboundedWrites++
+		log.Printf("%sUPDATE/DELETE without WHERE from %s: %s%s", COLOR_RED, rs.hostPort,
+			escapeControlBytes(cleanupQueryWithMode(query, rs.sqlMode)), COLOR_DEFAULT)
 	}
-	defer handle.Close()
 
-	err = handle.SetBPFFilter(fmt.Sprintf("tcp port %d", port))
-	if err != nil {
-		log.Fatalf("Failed to set port filter: %s", err.Error())
+	if fn := timeWastingCall(query); fn != "" {
+		stats.timeWastingQueries++
+		log.Printf("%s%s() called from %s: %s%s", COLOR_RED, fn, rs.hostPort,
+			escapeControlBytes(cleanupQueryWithMode(query, rs.sqlMode)), COLOR_DEFAULT)
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	if isCartesianJoin(query) {
+		stats.cartesianJoins++
+		slog.Warn("query joins tables without a join condition", "src", rs.hostPort, "query", cleanupQueryWithMode(query, rs.sqlMode))
+	}
+}
 
-	for packet := range packetSource.Packets() {
-		handlePacket(packet)
+// executedStatement is the SQL a COM_STMT_EXECUTE runs, looked up by the
+// statement ID at the start of its payload. Statements prepared before the
+// capture started are unknown and get a placeholder naming the ID.
+func executedStatement(rs *source, data []byte) (query []byte, known bool) {
+	if len(data) < 4 {
+		return data, false
 	}
+	id := binary.LittleEndian.Uint32(data[0:4])
+	if query, ok := rs.preparedStmts[id]; ok {
+		return []byte(query), true
+	}
+	return []byte(fmt.Sprintf("EXECUTE(stmt=%d)", id)), false
 }
 
-// extract the data using structured packet parsing with gopacket
-func handlePacket(packet gopacket.Packet) {
-	// Parse network layer to get IP addresses
-	networkLayer := packet.NetworkLayer()
-	if networkLayer == nil {
-		return
+// recordSchemaCommand notes a legacy COM_CREATE_DB or COM_DROP_DB, whose
+// payload is the database name. Clients rarely send these any more, and a
+// database dropped by production traffic is alarming, so both are called out.
+func recordSchemaCommand(rs *source, pType CommandType, name []byte) {
+	color := COLOR_YELLOW
+	if pType == CommandType(mysql.COM_DROP_DB) {
+		stats.dropDatabases++
+		color = COLOR_RED
+	} else {
+		stats.createDatabases++
 	}
+	log.Printf("%s%s from %s: database %s%s", color, pType.String(), rs.hostPort, escapeControlBytes(string(name)), COLOR_DEFAULT)
+}
 
-	// Parse transport layer to get TCP ports
-	tcpLayer := packet.Layer(layers.LayerTypeTCP)
-	if tcpLayer == nil {
+// processResponse handles MySQL response packets (results from server to client)
+func processResponse(rs *source, data []byte, ts time.Time) {
+	// Accumulate response data
+	if rs.respBuffer == nil {
+		rs.respBuffer = data
+	} else {
+		rs.respBuffer = append(rs.respBuffer, data...)
+	}
+
+	if rs.auth.phase == authPending {
+		processAuthResponse(rs)
 		return
 	}
-	tcp, _ := tcpLayer.(*layers.TCP)
 
-	// Get IP layer for addresses
-	var srcIP, dstIP string
-	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
-		ipv4, _ := ipv4Layer.(*layers.IPv4)
-		srcIP = ipv4.SrcIP.String()
-		dstIP = ipv4.DstIP.String()
-	} else {
-		// TODO: Add IPv6 support
+	// Binlog events aren't responses to anything we're timing
+	if rs.replica {
+		rs.respBuffer = nil
 		return
 	}
 
-	// Extract ports
-	srcPort := uint16(tcp.SrcPort)
-	dstPort := uint16(tcp.DstPort)
+	// Whatever we're buffering, we've lost track of it by now
+	if len(rs.respBuffer) > maxBufferSize {
+		slog.Debug("response buffer over limit, dropping", "hostPort", rs.hostPort, "size", len(rs.respBuffer))
+		desyncSource(rs)
+		return
+	}
 
-	// Get application layer payload
-	applicationLayer := packet.ApplicationLayer()
-	if applicationLayer == nil {
+	// If we haven't sent a request, we're still accumulating data
+	if rs.reqSent == nil {
 		return
 	}
-	payload := applicationLayer.Payload()
 
-	// If this is a 0-length payload, do nothing.
-	if len(payload) <= 0 {
+	// A response can span several TCP segments and several results; keep
+	// buffering until its final packet has arrived.
+	if !rs.response.feed(rs.respBuffer, rs.capabilities) {
 		return
 	}
 
-	// This is either an inbound or outbound packet. Determine by seeing which
-	// end contains our port. Either way, we want to put this on the channel of
-	// the remote end.
-	var src string
-	request := false
-	if srcPort == port {
-		src = fmt.Sprintf("%s:%d", dstIP, dstPort)
-		slog.Info("response", "src", src)
-	} else if dstPort == port {
-		src = fmt.Sprintf("%s:%d", srcIP, srcPort)
-		request = true
-		slog.Info("request", "src", src)
-	} else {
-		slog.Error("got unexpected packet", "srcPort", srcPort, "dstPort", dstPort)
-		os.Exit(1)
+	// Calculate request-response time
+	sent := *rs.reqSent
+	reqtime := uint64(ts.Sub(sent).Nanoseconds())
+
+	// Clear request timestamp
+	finishRequest(rs)
+
+	// A client trying LOAD DATA LOCAL against a server with local_infile
+	// off is misconfigured rather than hitting a query error
+	if rs.loadDataLocal && isLocalInfileDisabled(rs.respBuffer) {
+		stats.localInfileDisabled++
+		slog.Warn("LOAD DATA LOCAL refused, local_infile is disabled on the server", "src", rs.hostPort, "query", rs.qText)
 	}
+	rs.loadDataLocal = false
 
-	// Get the data structure for this source, then do something.
-	rs, ok := chmap[src]
-	if !ok {
-		srcIP := src[0:strings.Index(src, ":")]
-		rs = &source{hostPort: src, srcIP: srcIP, synced: false}
-		stats.streams++
-		chmap[src] = rs
+	if slowThreshold > 0 && time.Duration(reqtime) >= slowThreshold {
+		stats.slowQueries++
 	}
 
-	// Now with a source, process the packet.
-	processPacket(rs, request, payload)
-}
+	// Queries the filters left out have no text and weren't counted
+	if attrGroupBy != "" && len(rs.qText) > 0 {
+		value := connectAttr(rs, attrGroupBy)
+		attrLatency[value] += reqtime
+		attrTimed[value]++
+	}
 
-// processPacket dispatches packet processing to request or response handler
-func processPacket(rs *source, request bool, data []byte) {
-	stats.packets.rcvd++
-	if rs.synced {
-		stats.packets.rcvd_sync++
+	if rs.preparing != "" {
+		if id, ok := preparedStatementID(rs.respBuffer); ok {
+			if rs.preparedStmts == nil {
+				rs.preparedStmts = make(map[uint32]string)
+			}
+			if old, ok := rs.preparedStmts[id]; ok && old != rs.preparing {
+				log.Printf("%sStatement %d on %s prepared again without COM_STMT_CLOSE: %s (was %s)%s",
+					COLOR_YELLOW, id, rs.hostPort, escapeControlBytes(rs.preparing), escapeControlBytes(old), COLOR_DEFAULT)
+			}
+			rs.preparedStmts[id] = rs.preparing
+			if byPrepared {
+				shape := preparedShapeFor(rs.preparing)
+				shape.prepares++
+				shape.prepareTime += reqtime
+			}
+		}
+		rs.preparing = ""
+	}
+	if rs.executing != "" {
+		shape := preparedShapeFor(rs.executing)
+		shape.executeTime += reqtime
+		shape.executesTimed++
+		rs.executing = ""
 	}
 
-	if request {
-		processRequest(rs, data)
-	} else {
-		processResponse(rs, data)
+	if loki != nil && rs.lokiQuery != "" {
+		loki.offer(sent, rs.srcIP, rs.lokiQuery, reqtime)
 	}
-}
 
-// processRequest handles MySQL request packets (queries from client to server)
-func processRequest(rs *source, data []byte) {
-	slog.Info("receive request", "hostPort", rs.hostPort, "dataLength", len(data))
+	if rs.writeShape != "" {
+		affectedRows[rs.writeShape] += responseAffectedRows(rs.respBuffer)
+	}
 
-	// If we still have response buffer, we're in some weird state and
-	// didn't successfully process the response.
-	if rs.respBuffer != nil {
-		stats.desyncs++
-		rs.respBuffer = nil
-		rs.synced = false
+	// Display parsed query and result; repeats folded by -verbose-dedup
+	// don't use up the -verbose-rate allowance
+	if verboseDedup != nil {
+		verboseDedup.flush(ts)
+	}
+	if showQueryDetail(reqtime) && len(rs.qText) > 0 &&
+		(verboseDedup == nil || !verboseDedup.repeat(rs.hostPort, rs.qText, ts)) &&
+		(verboseLimit == nil || verboseLimit.allow(ts)) {
+		displayQueryResult(rs.hostPort, rs.qText, rs.respBuffer, reqtime, rs.qBytes, rs.capabilities, showRows, rs.charset.results)
 	}
 
-	rs.reqBuffer = data
-	pType, pData, err := carvePacket(&rs.reqBuffer)
+	// Clear response buffer after processing
+	rs.respBuffer = nil
+}
 
-	// Handle packet parsing errors (incomplete or malformed packets)
-	if err != nil {
-		slog.Debug("failed to parse packet", "error", err)
-		return
+// showQueryDetail decides whether a finished query gets the full display:
+// every query with -v, or with -sample-slow only those at least that slow,
+// so fast queries never pay for parsing their response.
+func showQueryDetail(reqtime uint64) bool {
+	if slowThreshold > 0 {
+		return time.Duration(reqtime) >= slowThreshold
 	}
+	return verbose
+}
 
-	// The synchronization logic: if we're not synced, we wait for a COM_QUERY
-	if !rs.synced {
-		if pType != CommandType(mysql.COM_QUERY) {
-			rs.reqBuffer, rs.respBuffer = nil, nil
+// processAuthResponse feeds buffered server packets to the authentication
+// exchange. Once the final OK arrives the packet framing is known to be
+// right, so the stream counts as synced.
+func processAuthResponse(rs *source) {
+	for rs.auth.phase == authPending {
+		pType, pData, err := carvePacket(&rs.respBuffer)
+		if err != nil {
 			return
 		}
+		rs.auth.serverPacket(append([]byte{byte(pType)}, pData...))
+	}
+
+	switch rs.auth.phase {
+	case authDone:
+		slog.Debug("authenticated", "hostPort", rs.hostPort, "plugin", rs.auth.plugin, "fullAuth", rs.auth.fullAuth)
 		rs.synced = true
+	case authFailed:
+		slog.Debug("authentication failed", "hostPort", rs.hostPort, "plugin", rs.auth.plugin)
 	}
+	rs.respBuffer = nil
+}
 
-	// Parse COM_QUERY data to extract actual SQL query text
-	// This handles both legacy format and MySQL 8.0.23+ query attributes
-	var parsedQuery []byte
-	if pType == CommandType(mysql.COM_QUERY) {
-		var err error
-		parsedQuery, err = parseComQuery(pData)
-		if err != nil {
-			slog.Debug("failed to parse COM_QUERY", "error", err)
-			return
+// closeStream handles either end closing a connection (FIN or RST). A
+// request still waiting then never gets its response: with part of the
+// response in, the client most likely gave up on it (a client-side timeout or
+// cancel); with none, the connection went away while the query ran.
+func closeStream(rs *source) {
+	if rs.inFlight {
+		if len(rs.respBuffer) > 0 {
+			stats.closedIncomplete++
+		} else {
+			stats.closedUnanswered++
 		}
-	} else {
-		// For non-COM_QUERY commands, use data as-is
-		parsedQuery = pData
 	}
-
-	// Record request timestamp
-	tnow := time.Now()
-	// FIXME: why use pointer here
-	rs.reqSent = &tnow
-
-	// Format the query text according to user preferences
-	text := formatQueryText(rs, parsedQuery)
-
-	// Store query text and bytes for display
-	rs.qText = text
-	rs.qBytes = uint64(len(pData))
+	finishRequest(rs)
+	rs.reqBuffer = nil
+	rs.respBuffer = nil
 }
 
-// processResponse handles MySQL response packets (results from server to client)
-func processResponse(rs *source, data []byte) {
-	// Accumulate response data
-	if rs.respBuffer == nil {
-		rs.respBuffer = data
-	} else {
-		rs.respBuffer = append(rs.respBuffer, data...)
-	}
+// desyncSource throws away everything buffered for a stream and waits for
+// the next COM_QUERY to resync
+func desyncSource(rs *source) {
+	stats.desyncs++
+	rs.synced = false
+	rs.reqBuffer = nil
+	rs.respBuffer = nil
+	finishRequest(rs)
+	rs.auth = authState{}
+}
 
-	// If we haven't sent a request, we're still accumulating data
-	if rs.reqSent == nil {
-		return
+// startRequest marks a command as sent and, if the server answers it, as in
+// flight until the answer arrives. A command sent while another is waiting
+// takes its place, since we'll never match up the earlier one now.
+func startRequest(rs *source, pType CommandType, ts time.Time) {
+	// FIXME: why use pointer here
+	rs.reqSent = &ts
+
+	switch byte(pType) {
+	case mysql.COM_QUIT, mysql.COM_STMT_CLOSE, mysql.COM_STMT_SEND_LONG_DATA:
+		// No response is coming
+		if rs.inFlight {
+			rs.inFlight = false
+			stats.inFlight--
+		}
+	default:
+		if !rs.inFlight {
+			rs.inFlight = true
+			stats.inFlight++
+			stats.maxInFlight = max(stats.maxInFlight, stats.inFlight)
+		}
 	}
+}
 
-	// Calculate request-response time
-	reqtime := uint64(time.Since(*rs.reqSent).Nanoseconds())
-
-	// Clear request timestamp
+// finishRequest clears the command in flight, answered or given up on
+func finishRequest(rs *source) {
 	rs.reqSent = nil
-
-	// Display parsed query and result in verbose mode
-	if verbose && len(rs.qText) > 0 {
-		displayQueryResult(rs.hostPort, rs.qText, rs.respBuffer, reqtime, rs.qBytes, showRows)
+	if rs.inFlight {
+		rs.inFlight = false
+		stats.inFlight--
 	}
-
-	// Clear response buffer after processing
-	rs.respBuffer = nil
 }
 
 // formatQueryText formats the query according to the user's format string
@@ -374,7 +1628,7 @@ func formatQueryText(rs *source, pdata []byte) string {
 				if dirty {
 					text += string(pdata)
 				} else {
-					text += cleanupQuery(pdata)
+					text += cleanupQueryWithMode(pdata, rs.sqlMode)
 				}
 			case F_ROUTE:
 				// Routes are in the query like:
@@ -388,7 +1642,7 @@ func formatQueryText(rs *source, pdata []byte) string {
 						text += parts[2]
 					}
 				} else {
-					text += "(unknown) " + cleanupQuery(pdata)
+					text += "(unknown) " + cleanupQueryWithMode(pdata, rs.sqlMode)
 				}
 			case F_SOURCE:
 				text += rs.hostPort
@@ -407,10 +1661,33 @@ func formatQueryText(rs *source, pdata []byte) string {
 	return text
 }
 
+// errEmptyPacket is returned by carvePacket for a zero-length packet, which it
+// consumes; the caller should move on to the next one
+var errEmptyPacket = errors.New("empty MySQL packet")
+
+// errChunkSequence is returned by carvePacket when the chunks of a 16MB+
+// payload aren't numbered one after another, so they aren't one payload and
+// we've lost track of the framing
+var errChunkSequence = errors.New("MySQL packet chunk out of sequence")
+
 // carvePacket tries to pull a packet out of a slice of bytes. If so, it removes
 // those bytes from the slice. Returns the command type, data payload, and any error.
 func carvePacket(buf *[]byte) (CommandType, []byte, error) {
 	dataLen := uint32(len(*buf))
+
+	// An empty packet is complete with just its header. The client sends one
+	// to end the file of a LOAD DATA LOCAL; if we get here we weren't
+	// following that exchange, so drop it rather than waiting forever for a
+	// command byte that isn't coming.
+	if dataLen >= 4 && (*buf)[0] == 0 && (*buf)[1] == 0 && (*buf)[2] == 0 {
+		if dataLen == 4 {
+			*buf = nil
+		} else {
+			*buf = (*buf)[4:]
+		}
+		return 0, nil, errEmptyPacket
+	}
+
 	// MySQL packet minimum size: 4 bytes header + 1 byte command type
 	if dataLen < 5 {
 		return 0, nil, errors.New("buffer too small for MySQL packet header")
@@ -434,14 +1711,39 @@ func carvePacket(buf *[]byte) (CommandType, []byte, error) {
 	pType := CommandType((*buf)[4])
 	data := (*buf)[5 : size+4]
 
-	// Update buffer to remove processed packet
-	if end >= dataLen {
+	// A payload of 16MB or more is split into chunks of the largest size a
+	// header can hold, each with its own header and the next sequence ID,
+	// ending with a shorter (possibly empty) one; the command is all of them
+	// joined.
+	if maxChunk := uint32(mysql.MaxPayloadLen); size == maxChunk {
+		joined := append([]byte(nil), data...)
+		seq := (*buf)[3]
+		for chunk := maxChunk; chunk == maxChunk; {
+			if dataLen < end+4 {
+				return 0, nil, errors.New("incomplete MySQL packet")
+			}
+			if seq++; (*buf)[end+3] != seq {
+				return 0, nil, fmt.Errorf("%w: got %d, want %d", errChunkSequence, (*buf)[end+3], seq)
+			}
+			chunk = uint32((*buf)[end]) + uint32((*buf)[end+1])<<8 + uint32((*buf)[end+2])<<16
+			if dataLen < end+4+chunk {
+				return 0, nil, errors.New("incomplete MySQL packet")
+			}
+			joined = append(joined, (*buf)[end+4:end+4+chunk]...)
+			end += 4 + chunk
+		}
+		data = joined
+	}
+
+	// Update buffer to remove processed packet. An exact fit leaves nothing
+	// buffered, which is always nil rather than an empty slice.
+	if end == dataLen {
 		*buf = nil
 	} else {
 		*buf = (*buf)[end:]
 	}
 
-	slog.Info("carved Packet", "dataLen", dataLen, "size", size, "end", end, "pType", pType.String(), "dataLen", len(data), "bufRemaining", len(*buf))
+	slog.Info("carved Packet", "dataLen", dataLen, "size", len(data)+1, "end", end, "pType", pType.String(), "dataLen", len(data), "bufRemaining", len(*buf))
 
 	return pType, data, nil
 }
@@ -511,19 +1813,37 @@ func parseComQuery(data []byte) ([]byte, error) {
 // a new type and need to stop scanning.  returns the size of the last token and
 // the type of it.
 func scanToken(query []byte) (length int, thistype int) {
-	if len(query) < 1 {
-		log.Fatalf("scanToken called with empty query")
-	}
+	return scanTokenWithMode(query, sqlMode{})
+}
 
+// scanTokenWithMode is scanToken for a session running with the given SQL
+// mode: ANSI_QUOTES makes "..." an identifier rather than a string, and
+// NO_BACKSLASH_ESCAPES stops backslash from escaping quotes.
+func scanTokenWithMode(query []byte, mode sqlMode) (length int, thistype int) {
 	//no clean queries
-	if verbose && noclean {
+	if verbose && noclean && len(query) > 0 {
 		return len(query), TOKEN_OTHER
 	}
+	return lexToken(query, mode)
+}
+
+// lexToken is scanTokenWithMode without -n, which only affects how queries
+// are displayed: anything analysing a query needs its real tokens.
+func lexToken(query []byte, mode sqlMode) (length int, thistype int) {
+	if len(query) < 1 {
+		log.Fatalf("scanToken called with empty query")
+	}
+
 	// peek at the first byte, then loop
 	b := query[0]
 	switch {
 	case b == 39 || b == 34: // '"
 		started_with := b
+		toktype := TOKEN_QUOTE
+		if b == 34 && mode.ansiQuotes {
+			// A quoted identifier; keep it like any other word
+			toktype = TOKEN_WORD
+		}
 		escaped := false
 		for i := 1; i < len(query); i++ {
 			switch query[i] {
@@ -532,14 +1852,14 @@ func scanToken(query []byte) (length int, thistype int) {
 					escaped = false
 					continue
 				}
-				return i + 1, TOKEN_QUOTE
+				return i + 1, toktype
 			case 92:
-				escaped = true
+				escaped = !mode.noBackslashEscapes
 			default:
 				escaped = false
 			}
 		}
-		return len(query), TOKEN_QUOTE
+		return len(query), toktype
 
 	case b >= 48 && b <= 57: // 0-9
 		for i := 1; i < len(query); i++ {
@@ -563,8 +1883,8 @@ func scanToken(query []byte) (length int, thistype int) {
 		}
 		return len(query), TOKEN_WHITESPACE
 
-	case (b >= 65 && b <= 90) || (b >= 97 && b <= 122): // a-zA-Z
-		for i := 1; i < len(query); i++ {
+	case (b >= 65 && b <= 90) || (b >= 97 && b <= 122) || utf8RuneLen(query) > 1: // a-zA-Z, non-ASCII
+		for i := utf8RuneLen(query); i < len(query); i++ {
 			switch {
 			case query[i] >= 48 && query[i] <= 57:
 				// Numbers, allow.
@@ -572,6 +1892,9 @@ func scanToken(query []byte) (length int, thistype int) {
 				// Letters, allow.
 			case query[i] == 36 || query[i] == 95:
 				// $ and _
+			case utf8RuneLen(query[i:]) > 1:
+				// Non-ASCII identifier characters; skip the rest of the rune
+				i += utf8RuneLen(query[i:]) - 1
 			default:
 				return i, TOKEN_WORD
 			}
@@ -581,23 +1904,84 @@ func scanToken(query []byte) (length int, thistype int) {
 	default: // everything else
 		return 1, TOKEN_OTHER
 	}
+}
+
+// utf8RuneLen returns the length of the valid multibyte UTF-8 character at
+// the start of b, or 1 for ASCII and bytes that aren't valid UTF-8, so that
+// binary garbage from a desynced stream doesn't turn into words.
+func utf8RuneLen(b []byte) int {
+	if len(b) == 0 || b[0] < utf8.RuneSelf {
+		return 1
+	}
+	r, size := utf8.DecodeRune(b)
+	if r == utf8.RuneError {
+		return 1
+	}
+	return size
+}
+
+// queryVerb returns the leading keyword of a query in upper case, skipping
+// whitespace, comments and opening parentheses. It deliberately doesn't
+// tokenize the rest of the query.
+func queryVerb(query []byte) string {
+	i, j := verbBounds(query)
+	if j == i {
+		return "UNKNOWN"
+	}
+	return strings.ToUpper(string(query[i:j]))
+}
+
+// verbBounds returns where the leading keyword of a query starts and ends, as
+// found by queryVerb; the two are equal when there isn't one.
+func verbBounds(query []byte) (int, int) {
+	i := 0
+	for i < len(query) {
+		b := query[i]
+		if b == 32 || (b >= 9 && b <= 13) || b == '(' {
+			i++
+		} else if b == '/' && i+1 < len(query) && query[i+1] == '*' {
+			end := bytes.Index(query[i+2:], []byte("*/"))
+			if end < 0 {
+				return 0, 0
+			}
+			i += end + 4
+		} else {
+			break
+		}
+	}
 
-	// shouldn't get here
-	log.Fatalf("scanToken failure: [%s]", query)
-	return
+	j := i
+	for j < len(query) && ((query[j] >= 65 && query[j] <= 90) || (query[j] >= 97 && query[j] <= 122)) {
+		j++
+	}
+	return i, j
 }
 
 func cleanupQuery(query []byte) string {
+	return cleanupQueryWithMode(query, sqlMode{})
+}
+
+// cleanupQueryWithMode is cleanupQuery for a session with the given SQL mode
+func cleanupQueryWithMode(query []byte, mode sqlMode) string {
+	query = stripProxyHints(query, mode)
+
 	// iterate until we hit the end of the query...
 	var qspace []string
 	for i := 0; i < len(query); {
-		length, toktype := scanToken(query[i:])
+		length, toktype := scanTokenWithMode(query[i:], mode)
 
 		switch toktype {
 		case TOKEN_WORD, TOKEN_OTHER:
 			qspace = append(qspace, string(query[i:i+length]))
 
-		case TOKEN_NUMBER, TOKEN_QUOTE:
+		case TOKEN_NUMBER:
+			if keepBooleans && isBooleanLiteral(query, i, length) {
+				qspace = append(qspace, string(query[i:i+length]))
+			} else {
+				qspace = append(qspace, "?")
+			}
+
+		case TOKEN_QUOTE:
 			qspace = append(qspace, "?")
 
 		case TOKEN_WHITESPACE:
@@ -610,6 +1994,13 @@ func cleanupQuery(query []byte) string {
 		i += length
 	}
 
+	if normalizeOperators {
+		qspace = normalizeOperatorSpacing(qspace)
+	}
+	if ignoreOrdering {
+		qspace = stripOrdering(qspace)
+	}
+
 	// Remove hostname from the route information if it's present
 	tmp := strings.Join(qspace, "")
 
@@ -631,6 +2022,221 @@ func cleanupQuery(query []byte) string {
 	return tmp
 }
 
+// isBooleanLiteral reports whether the number token at query[i:i+length] is a
+// bare 0 or 1, rather than part of something like 1.5 or 0x1f
+func isBooleanLiteral(query []byte, i, length int) bool {
+	if length != 1 || (query[i] != '0' && query[i] != '1') {
+		return false
+	}
+	if i > 0 && query[i-1] == '.' {
+		return false
+	}
+	if end := i + length; end < len(query) {
+		next := query[end]
+		if next == '.' || next == '_' || next == '$' ||
+			(next >= 'a' && next <= 'z') || (next >= 'A' && next <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// spacedOperators are the operators -normalize-operator-spacing puts single
+// spaces around, longest first so <=> isn't read as <= followed by >
+var spacedOperators = []string{"<=>", "->>", "<=", ">=", "!=", "<>", ":=", "->", "<<", ">>", "=", "<", ">", "+", "-"}
+
+// normalizeOperatorSpacing rewrites the canonical tokens of a query so that
+// every binary operator has exactly one space on either side, however it was
+// written. A + or - that opens an operand (after another operator, an opening
+// parenthesis, a comma or at the start) is a sign rather than an operator, so
+// it stays attached to what follows: id=-1, id = - 1 and id =-1 all become
+// id = -?.
+func normalizeOperatorSpacing(tokens []string) []string {
+	isOperator := func(tok string) bool {
+		for _, op := range spacedOperators {
+			if tok == op {
+				return true
+			}
+		}
+		return false
+	}
+	// matchOperator returns the operator spelled by the single-character
+	// tokens at the start of tokens, if any
+	matchOperator := func(tokens []string) string {
+		for _, op := range spacedOperators {
+			if len(tokens) < len(op) {
+				continue
+			}
+			matched := true
+			for k := 0; k < len(op); k++ {
+				if tokens[k] != op[k:k+1] {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				return op
+			}
+		}
+		return ""
+	}
+
+	var out []string
+	for i := 0; i < len(tokens); {
+		op := matchOperator(tokens[i:])
+		if op == "" {
+			out = append(out, tokens[i])
+			i++
+			continue
+		}
+
+		prev := ""
+		for j := len(out) - 1; j >= 0; j-- {
+			if out[j] != " " {
+				prev = out[j]
+				break
+			}
+		}
+
+		if (op == "+" || op == "-") && (prev == "" || prev == "(" || prev == "," || isOperator(prev)) {
+			out = append(out, op)
+		} else {
+			for len(out) > 0 && out[len(out)-1] == " " {
+				out = out[:len(out)-1]
+			}
+			out = append(out, " ", op, " ")
+		}
+
+		i += len(op)
+		for i < len(tokens) && tokens[i] == " " {
+			i++
+		}
+	}
+	return out
+}
+
+// stripOrdering removes the outermost ORDER BY and LIMIT clauses from the
+// canonical tokens of a query. Only the ordering and paging go; a locking
+// clause, INTO or UNION after them is kept, and an ORDER BY inside
+// parentheses (a subquery or a window) is left alone.
+func stripOrdering(tokens []string) []string {
+	// word returns the upper-cased token at i, and the index of the next
+	// token that isn't whitespace
+	word := func(i int) (string, int) {
+		next := i + 1
+		for next < len(tokens) && tokens[next] == " " {
+			next++
+		}
+		return strings.ToUpper(tokens[i]), next
+	}
+
+	depth := 0
+	cut, end := -1, len(tokens)
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "(":
+			depth++
+			continue
+		case ")":
+			depth--
+			continue
+		}
+		if depth != 0 {
+			continue
+		}
+
+		w, next := word(i)
+		if cut < 0 {
+			if w == "LIMIT" || (w == "ORDER" && next < len(tokens) && strings.ToUpper(tokens[next]) == "BY") {
+				cut = i
+			}
+			continue
+		}
+		if w == "FOR" || w == "LOCK" || w == "INTO" || w == "UNION" {
+			end = i
+			break
+		}
+	}
+	if cut < 0 {
+		return tokens
+	}
+
+	out := append([]string{}, tokens[:cut]...)
+	for len(out) > 0 && out[len(out)-1] == " " {
+		out = out[:len(out)-1]
+	}
+	if end < len(tokens) {
+		out = append(out, " ")
+		out = append(out, tokens[end:]...)
+	}
+	return out
+}
+
+// prettyPrintQuery breaks a query onto multiple lines, one per major clause
+// (FROM, JOIN, WHERE, GROUP BY, ORDER BY, LIMIT), for display. It only
+// replaces the whitespace in front of those keywords, so joining the lines
+// back with spaces gives the original query.
+func prettyPrintQuery(query string) string {
+	tokens, types := queryTokens([]byte(query))
+
+	// wordIndex returns the index of the next word token in direction step
+	// from token i, skipping whitespace, or -1 if anything else is in the way.
+	wordIndex := func(i, step int) int {
+		for j := i + step; j >= 0 && j < len(tokens); j += step {
+			switch types[j] {
+			case TOKEN_WHITESPACE:
+				continue
+			case TOKEN_WORD:
+				return j
+			default:
+				return -1
+			}
+		}
+		return -1
+	}
+	upper := func(i int) string {
+		if i < 0 {
+			return ""
+		}
+		return strings.ToUpper(tokens[i])
+	}
+	joinModifiers := map[string]bool{"LEFT": true, "RIGHT": true, "INNER": true, "OUTER": true,
+		"CROSS": true, "NATURAL": true, "FULL": true}
+
+	startsClause := func(i int) bool {
+		if types[i] != TOKEN_WORD {
+			return false
+		}
+		switch word := upper(i); {
+		case word == "FROM" || word == "WHERE" || word == "LIMIT":
+			return true
+		case word == "GROUP" || word == "ORDER":
+			return upper(wordIndex(i, 1)) == "BY"
+		case word == "JOIN" || joinModifiers[word]:
+			// Break before the first word of "LEFT OUTER JOIN" and friends
+			if joinModifiers[upper(wordIndex(i, -1))] {
+				return false
+			}
+			j := i
+			for j >= 0 && joinModifiers[upper(j)] {
+				j = wordIndex(j, 1)
+			}
+			return upper(j) == "JOIN"
+		}
+		return false
+	}
+
+	var out strings.Builder
+	for i, tok := range tokens {
+		if types[i] == TOKEN_WHITESPACE && i > 0 && i+1 < len(tokens) && startsClause(i+1) {
+			out.WriteString("\n")
+			continue
+		}
+		out.WriteString(tok)
+	}
+	return out.String()
+}
+
 // parseFormat takes a string and parses it out into the given format slice
 // that we later use to build up a string. This might actually be an overcomplicated
 // solution?
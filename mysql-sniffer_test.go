@@ -1,10 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 // ========== cleanupQuery Tests ==========
@@ -480,7 +499,7 @@ func TestParseResultSetResponse(t *testing.T) {
 		if len(pkt) > 0 && pkt[0] == 0xfe {
 			break // EOF packet
 		}
-		colName := parseColumnDefinition(pkt)
+		colName := parseColumnDefinition(pkt).name
 		columns = append(columns, colName)
 	}
 
@@ -652,3 +671,3503 @@ func containsHelper(s, substr string) bool {
 	}
 	return false
 }
+
+// ========== anonymizeIP Tests ==========
+
+func TestAnonymizeIP(t *testing.T) {
+	anonKey = []byte("test key")
+	anonCache = make(map[string]string)
+
+	a := anonymizeIP("10.1.2.3")
+	if a == "10.1.2.3" {
+		t.Errorf("anonymizeIP(%q) returned the address unchanged", "10.1.2.3")
+	}
+	if again := anonymizeIP("10.1.2.3"); again != a {
+		t.Errorf("anonymizeIP(%q) is not stable: got %q then %q", "10.1.2.3", a, again)
+	}
+
+	b := anonymizeIP("10.1.2.4")
+	if b == a {
+		t.Errorf("anonymizeIP mapped different addresses to the same pseudonym %q", a)
+	}
+
+	// Both addresses share a /24, so the pseudonyms must as well.
+	ipA, ipB := net.ParseIP(a).To4(), net.ParseIP(b).To4()
+	if ipA == nil || ipB == nil {
+		t.Fatalf("anonymizeIP returned non-IPv4 pseudonyms %q and %q", a, b)
+	}
+	if !ipA.Mask(net.CIDRMask(24, 32)).Equal(ipB.Mask(net.CIDRMask(24, 32))) {
+		t.Errorf("anonymizeIP did not preserve the shared /24: %q vs %q", a, b)
+	}
+
+	if v6 := anonymizeIP("2001:db8::1"); net.ParseIP(v6) == nil || net.ParseIP(v6).To4() != nil {
+		t.Errorf("anonymizeIP(%q) = %q, want an IPv6 pseudonym", "2001:db8::1", v6)
+	}
+}
+
+// ========== processResponse Tests ==========
+
+// captureVerbose turns on verbose mode and redirects slog into a buffer for
+// the duration of the test.
+func captureVerbose(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	oldLogger, oldVerbose := slog.Default(), verbose
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	verbose = true
+	t.Cleanup(func() {
+		slog.SetDefault(oldLogger)
+		verbose = oldVerbose
+	})
+	return &buf
+}
+
+// mysqlPacket frames a payload with a MySQL packet header.
+func mysqlPacket(seq byte, payload []byte) []byte {
+	size := len(payload)
+	return append([]byte{byte(size), byte(size >> 8), byte(size >> 16), seq}, payload...)
+}
+
+func TestProcessResponseSplitHeader(t *testing.T) {
+	out := captureVerbose(t)
+
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	sent := time.Now()
+	rs.reqSent = &sent
+	rs.qText = "update t set x=?"
+
+	// OK packet, 2 affected rows; the first segment carries only part of the header.
+	resp := mysqlPacket(1, []byte{0x00, 0x02, 0x00, 0x02, 0x00, 0x00, 0x00})
+	processResponse(rs, resp[:2], time.Now())
+
+	if rs.reqSent == nil {
+		t.Fatalf("response finalized on a partial header")
+	}
+	if len(rs.respBuffer) != 2 {
+		t.Errorf("respBuffer length = %d, want 2", len(rs.respBuffer))
+	}
+
+	processResponse(rs, resp[2:], time.Now())
+
+	if rs.reqSent != nil {
+		t.Errorf("response not finalized once the OK packet was complete")
+	}
+	if rs.respBuffer != nil {
+		t.Errorf("respBuffer not cleared after finalizing, %d bytes left", len(rs.respBuffer))
+	}
+	if !strings.Contains(out.String(), "2 row(s) affected") {
+		t.Errorf("expected the OK packet to be parsed, got: %s", out.String())
+	}
+}
+
+func TestProcessResponseSplitResultSet(t *testing.T) {
+	captureVerbose(t)
+
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	sent := time.Now()
+	rs.reqSent = &sent
+	rs.qText = "select id from t"
+
+	var head []byte
+	head = append(head, mysqlPacket(1, []byte{0x01})...)
+	head = append(head, mysqlPacket(2, []byte("\x03def\x02db\x01t\x01t\x02id\x02id\x0c?\x00\x0b\x00\x00\x00\x03\x03B\x00\x00\x00"))...)
+	head = append(head, mysqlPacket(3, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})...)
+
+	var tail []byte
+	tail = append(tail, mysqlPacket(4, []byte("\x011"))...)
+	tail = append(tail, mysqlPacket(5, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})...)
+
+	// The EOF after the column definitions must not be mistaken for the end.
+	processResponse(rs, head, time.Now())
+	if rs.reqSent == nil {
+		t.Fatalf("result set finalized before its rows arrived")
+	}
+
+	processResponse(rs, tail, time.Now())
+	if rs.reqSent != nil {
+		t.Errorf("result set not finalized after its terminating EOF")
+	}
+}
+
+// ========== pprof Tests ==========
+
+func TestStartPprof(t *testing.T) {
+	addr, err := startPprof("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("startPprof() error = %v", err)
+	}
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Errorf("GET %s error = %v", path, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s status = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+// ========== Column Type Tests ==========
+
+// columnDefPacket builds a column definition packet for the given name and type.
+func columnDefPacket(name string, colType byte) []byte {
+	return columnDefPacketWithFlags(name, colType, 0)
+}
+
+// columnDefPacketWithFlags is columnDefPacket with column flags set
+func columnDefPacketWithFlags(name string, colType byte, flags uint16) []byte {
+	lenenc := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	var pkt []byte
+	for _, s := range []string{"def", "db", "t", "t", name, name} {
+		pkt = append(pkt, lenenc(s)...)
+	}
+	// fixed fields: length, charset, column length, type, flags, decimals, filler
+	pkt = append(pkt, 0x0c, 0x3f, 0x00, 0x00, 0x00, 0x00, 0x00, colType, byte(flags), byte(flags>>8), 0x00, 0x00, 0x00)
+	return pkt
+}
+
+func TestParseColumnDefinitionFlags(t *testing.T) {
+	flags := uint16(mysql.NOT_NULL_FLAG | mysql.PRI_KEY_FLAG | mysql.AUTO_INCREMENT_FLAG)
+	col := parseColumnDefinition(columnDefPacketWithFlags("id", mysql.MYSQL_TYPE_LONG, flags))
+	if col.flags != flags {
+		t.Errorf("flags = %#x, want %#x", col.flags, flags)
+	}
+	if got := col.label(); got != "id(PK,AI)" {
+		t.Errorf("label() = %q, want %q", got, "id(PK,AI)")
+	}
+
+	// Annotated in the row display; plain columns stay plain
+	var resp [][]byte
+	resp = append(resp, []byte{0x02})
+	resp = append(resp, columnDefPacketWithFlags("id", mysql.MYSQL_TYPE_LONG, flags))
+	resp = append(resp, columnDefPacket("name", mysql.MYSQL_TYPE_VAR_STRING))
+	resp = append(resp, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})
+	resp = append(resp, []byte("\x011\x05alice"))
+	resp = append(resp, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})
+	result := parseResultSetFull(resp, mysql.CLIENT_PROTOCOL_41, true, "")
+	if !strings.Contains(result, "id(PK,AI)"+COLOR_DEFAULT+"="+COLOR_WHITE+"1") {
+		t.Errorf("row display missing the id(PK,AI) annotation: %q", result)
+	}
+	if !strings.Contains(result, COLOR_CYAN+"name"+COLOR_DEFAULT+"=") {
+		t.Errorf("row display annotated a plain column: %q", result)
+	}
+}
+
+func TestParseColumnDefinitionType(t *testing.T) {
+	col := parseColumnDefinition(columnDefPacket("location", mysql.MYSQL_TYPE_GEOMETRY))
+	if col.name != "location" {
+		t.Errorf("name = %q, want %q", col.name, "location")
+	}
+	if col.colType != mysql.MYSQL_TYPE_GEOMETRY {
+		t.Errorf("colType = %#x, want %#x", col.colType, mysql.MYSQL_TYPE_GEOMETRY)
+	}
+}
+
+// pointValue encodes a POINT in MySQL's internal format: SRID + little-endian WKB.
+func pointValue(srid uint32, x, y float64) []byte {
+	val := binary.LittleEndian.AppendUint32(nil, srid)
+	val = append(val, 0x01)
+	val = binary.LittleEndian.AppendUint32(val, 1)
+	val = binary.LittleEndian.AppendUint64(val, math.Float64bits(x))
+	val = binary.LittleEndian.AppendUint64(val, math.Float64bits(y))
+	return val
+}
+
+func TestFormatGeometryPoint(t *testing.T) {
+	got := formatGeometry(pointValue(4326, 1.5, -2))
+	if want := "POINT(1.5 -2) SRID=4326"; got != want {
+		t.Errorf("formatGeometry() = %q, want %q", got, want)
+	}
+
+	// Too short to be WKB: fall back to hex
+	if got := formatGeometry([]byte{0x01, 0x02}); got != "0x0102" {
+		t.Errorf("formatGeometry(short) = %q, want %q", got, "0x0102")
+	}
+}
+
+func TestParseResultSetFullGeometry(t *testing.T) {
+	point := pointValue(0, 3, 4)
+	row := append([]byte{byte(len(point))}, point...)
+
+	packets := [][]byte{
+		{0x01},
+		columnDefPacket("location", mysql.MYSQL_TYPE_GEOMETRY),
+		{0xfe, 0x00, 0x00, 0x02, 0x00},
+		row,
+		{0xfe, 0x00, 0x00, 0x02, 0x00},
+	}
+
+	result := parseResultSetFull(packets, 0, true, "")
+	if !strings.Contains(result, "POINT(3 4) SRID=0") {
+		t.Errorf("parseResultSetFull() should render the geometry, got: %s", result)
+	}
+}
+
+// ========== Handshake Tests ==========
+
+// handshakeResponsePayload builds a HandshakeResponse41 payload with the given
+// capabilities, for user "app" with an empty password.
+func handshakeResponsePayload(capabilities uint32) []byte {
+	payload := binary.LittleEndian.AppendUint32(nil, capabilities)
+	payload = binary.LittleEndian.AppendUint32(payload, 1<<24) // max packet size
+	payload = append(payload, 0x2d)                            // utf8mb4
+	payload = append(payload, make([]byte, 23)...)
+	payload = append(payload, "app\x00"...)
+	payload = append(payload, 0x00) // auth response length
+	return payload
+}
+
+func TestParseHandshakeResponse(t *testing.T) {
+	caps := mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_OPTIONAL_RESULTSET_METADATA
+	hs, ok := parseHandshakeResponse(handshakeResponsePayload(caps))
+	if !ok {
+		t.Fatalf("parseHandshakeResponse() did not recognize a handshake response")
+	}
+	if hs.capabilities != caps {
+		t.Errorf("capabilities = %#x, want %#x", hs.capabilities, caps)
+	}
+
+	// A COM_QUERY is not a handshake response, however long it is
+	if _, ok := parseHandshakeResponse(append([]byte{mysql.COM_QUERY}, "select * from some_table_with_a_long_name"...)); ok {
+		t.Errorf("parseHandshakeResponse() accepted a COM_QUERY payload")
+	}
+}
+
+func TestProcessRequestRecordsCapabilities(t *testing.T) {
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1"}
+	caps := mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_OPTIONAL_RESULTSET_METADATA
+
+	processRequest(rs, mysqlPacket(1, handshakeResponsePayload(caps)), time.Now())
+
+	if rs.capabilities != caps {
+		t.Errorf("capabilities = %#x, want %#x", rs.capabilities, caps)
+	}
+	if rs.synced {
+		t.Errorf("stream synced on a handshake response")
+	}
+}
+
+// A connection seen from its SYN leaves the server's greeting unconsumed;
+// the handshake response that follows it is no desync
+func TestFullHandshakeNoDesync(t *testing.T) {
+	savedStats := stats
+	defer func() { stats = savedStats }()
+	stats.desyncs, stats.queries = 0, 0
+	serverPorts = []portRange{{3306, 3306}}
+	defer func() { serverPorts = nil }()
+	chmap = make(map[string]*source)
+
+	greeting := mysqlPacket(0, append([]byte{0x0a}, "8.0.36\x00"...))
+	handshake := mysqlPacket(1, pluginHandshakeResponse("caching_sha2_password"))
+	ok := mysqlPacket(2, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+	query := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))
+
+	handlePacket(tcpSegment(t, 51000, true, true, 1000, nil))
+	handlePacket(tcpSegment(t, 51000, false, true, 5000, nil))
+	handlePacket(tcpSegment(t, 51000, false, false, 5001, greeting))
+	handlePacket(tcpSegment(t, 51000, true, false, 1001, handshake))
+	handlePacket(tcpSegment(t, 51000, false, false, 5001+uint32(len(greeting)), ok))
+	handlePacket(tcpSegment(t, 51000, true, false, 1001+uint32(len(handshake)), query))
+
+	if stats.desyncs != 0 {
+		t.Errorf("desyncs = %d after a full handshake, want 0", stats.desyncs)
+	}
+	if stats.queries != 1 {
+		t.Errorf("queries = %d, want 1", stats.queries)
+	}
+}
+
+// pluginHandshakeResponse builds a HandshakeResponse41 naming an auth plugin
+func pluginHandshakeResponse(plugin string) []byte {
+	caps := mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_PLUGIN_AUTH
+	payload := handshakeResponsePayload(caps)
+	return append(payload, plugin+"\x00"...)
+}
+
+func TestParseHandshakeResponsePlugin(t *testing.T) {
+	hs, ok := parseHandshakeResponse(pluginHandshakeResponse("caching_sha2_password"))
+	if !ok || hs.plugin != "caching_sha2_password" {
+		t.Errorf("parseHandshakeResponse() = %+v, %v, want plugin caching_sha2_password", hs, ok)
+	}
+
+	sslCaps := mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_SSL
+	hs, ok = parseHandshakeResponse(handshakeResponsePayload(sslCaps)[:32])
+	if !ok || !hs.sslRequest {
+		t.Errorf("parseHandshakeResponse() = %+v, %v, want an SSL request", hs, ok)
+	}
+}
+
+func TestAuthCachingSHA2FastAuth(t *testing.T) {
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1"}
+
+	processRequest(rs, mysqlPacket(1, pluginHandshakeResponse("caching_sha2_password")), time.Now())
+	if rs.auth.phase != authPending {
+		t.Fatalf("after handshake response: phase = %v, want authPending", rs.auth.phase)
+	}
+
+	// Fast-auth success is not the end; the OK follows
+	processResponse(rs, mysqlPacket(2, []byte{AUTH_MORE_DATA, CACHING_SHA2_FAST_AUTH_SUCCESS}), time.Now())
+	if rs.auth.phase != authPending || rs.synced {
+		t.Fatalf("after fast-auth success: phase = %v, synced = %v, want authPending and unsynced", rs.auth.phase, rs.synced)
+	}
+
+	processResponse(rs, mysqlPacket(3, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), time.Now())
+	if rs.auth.phase != authDone || !rs.synced {
+		t.Errorf("after OK: phase = %v, synced = %v, want authDone and synced", rs.auth.phase, rs.synced)
+	}
+	if rs.auth.fullAuth {
+		t.Errorf("fullAuth = true for a fast-auth exchange")
+	}
+	if rs.respBuffer != nil {
+		t.Errorf("respBuffer holds %d bytes after auth, want none", len(rs.respBuffer))
+	}
+}
+
+func TestAuthCachingSHA2FullAuth(t *testing.T) {
+	stats.queries = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1"}
+
+	processRequest(rs, mysqlPacket(1, pluginHandshakeResponse("caching_sha2_password")), time.Now())
+	processResponse(rs, mysqlPacket(2, []byte{AUTH_MORE_DATA, CACHING_SHA2_PERFORM_FULL_AUTH}), time.Now())
+	if !rs.auth.fullAuth {
+		t.Errorf("fullAuth = false after a perform-full-auth request")
+	}
+
+	// The client asks for the public key, then sends the encrypted password.
+	// Neither is a command, even when the ciphertext starts with 0x03.
+	processRequest(rs, mysqlPacket(3, []byte{0x02}), time.Now())
+	processResponse(rs, mysqlPacket(4, append([]byte{AUTH_MORE_DATA}, "-----BEGIN PUBLIC KEY-----"...)), time.Now())
+	processRequest(rs, mysqlPacket(5, append([]byte{mysql.COM_QUERY}, make([]byte, 255)...)), time.Now())
+	if rs.auth.phase != authPending || stats.queries != 0 {
+		t.Fatalf("before OK: phase = %v, queries = %d, want authPending and 0", rs.auth.phase, stats.queries)
+	}
+
+	processResponse(rs, mysqlPacket(6, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), time.Now())
+	if rs.auth.phase != authDone || !rs.synced {
+		t.Errorf("after OK: phase = %v, synced = %v, want authDone and synced", rs.auth.phase, rs.synced)
+	}
+}
+
+func TestAuthSwitchToClearPassword(t *testing.T) {
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1"}
+
+	processRequest(rs, mysqlPacket(1, pluginHandshakeResponse("mysql_native_password")), time.Now())
+	processResponse(rs, mysqlPacket(2, append([]byte{AUTH_SWITCH_REQUEST}, "mysql_clear_password\x00"...)), time.Now())
+	if rs.auth.plugin != "mysql_clear_password" {
+		t.Errorf("plugin = %q after auth switch, want mysql_clear_password", rs.auth.plugin)
+	}
+
+	processRequest(rs, mysqlPacket(3, []byte("secret\x00")), time.Now())
+	processResponse(rs, mysqlPacket(4, []byte{0xff, 0x15, 0x04, '#', '2', '8', '0', '0', '0'}), time.Now())
+	if rs.auth.phase != authFailed || rs.synced {
+		t.Errorf("after ERROR: phase = %v, synced = %v, want authFailed and unsynced", rs.auth.phase, rs.synced)
+	}
+}
+
+func TestParseResultSetFullMetadataOmitted(t *testing.T) {
+	caps := mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_DEPRECATE_EOF | mysql.CLIENT_OPTIONAL_RESULTSET_METADATA
+
+	// 2 columns, metadata_follows = NONE, two rows, then an OK standing in for EOF
+	var resp []byte
+	resp = append(resp, mysqlPacket(1, []byte{0x02, RESULTSET_METADATA_NONE})...)
+	resp = append(resp, mysqlPacket(2, []byte("\x011\x05alice"))...)
+	resp = append(resp, mysqlPacket(3, []byte("\x012\x03bob"))...)
+	resp = append(resp, mysqlPacket(4, []byte{0xfe, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})...)
+
+	var m responseMachine
+	if !m.feed(resp, caps) {
+		t.Errorf("feed() = false for a complete metadata-omitted result set")
+	}
+
+	result := parseResultSetFull(collectAllResponsePackets(resp), caps, true, "")
+	if !strings.Contains(result, "Total: 2 row(s)") {
+		t.Errorf("parseResultSetFull() should count both rows, got: %s", result)
+	}
+	if !strings.Contains(result, "alice") || !strings.Contains(result, "bob") {
+		t.Errorf("parseResultSetFull() should show the row values, got: %s", result)
+	}
+}
+
+// ========== Count-only Tests ==========
+
+func TestQueryVerb(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"select * from t", "SELECT"},
+		{"  \n\tInsert into t values (1)", "INSERT"},
+		{"/* app:route */ update t set x=1", "UPDATE"},
+		{"(select 1) union (select 2)", "SELECT"},
+		{"/* unterminated", "UNKNOWN"},
+		{"", "UNKNOWN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := queryVerb([]byte(tt.input)); got != tt.want {
+				t.Errorf("queryVerb(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountOnlyVerbCounts(t *testing.T) {
+	countOnly = true
+	verbCounts = make(map[string]uint64)
+	stats.queries = 0
+	defer func() { countOnly = false }()
+
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1"}
+	for _, q := range []string{"select 1", "SELECT * FROM t", "insert into t values (1)", "select 2"} {
+		processPacket(rs, true, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+	}
+	// Responses and non-query commands are ignored
+	processPacket(rs, false, mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), time.Now())
+	processPacket(rs, true, mysqlPacket(0, []byte{mysql.COM_PING}), time.Now())
+
+	want := map[string]uint64{"SELECT": 3, "INSERT": 1}
+	if !reflect.DeepEqual(verbCounts, want) {
+		t.Errorf("verbCounts = %v, want %v", verbCounts, want)
+	}
+	if stats.queries != 4 {
+		t.Errorf("stats.queries = %d, want 4", stats.queries)
+	}
+	if rs.respBuffer != nil || rs.qText != "" {
+		t.Errorf("count-only mode should not buffer responses or canonicalize queries")
+	}
+}
+
+func benchmarkProcessRequest(b *testing.B, countOnlyMode bool) {
+	oldLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	countOnly = countOnlyMode
+	format = nil
+	parseFormat("#s:#q")
+	defer func() {
+		slog.SetDefault(oldLogger)
+		countOnly = false
+	}()
+
+	pkt := mysqlPacket(0, append([]byte{mysql.COM_QUERY},
+		"SELECT u.id, u.name, u.email FROM users u WHERE u.id IN (1, 2, 3, 4, 5) AND u.status = 'active' ORDER BY u.created_at DESC LIMIT 10"...))
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		processPacket(rs, true, pkt, time.Now())
+	}
+}
+
+func BenchmarkProcessRequestFull(b *testing.B) {
+	benchmarkProcessRequest(b, false)
+}
+
+func BenchmarkProcessRequestCountOnly(b *testing.B) {
+	benchmarkProcessRequest(b, true)
+}
+
+// ========== processRequest Tests ==========
+
+func TestProcessRequestMultiplePackets(t *testing.T) {
+	stats.queries = 0
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1"}
+
+	var data []byte
+	data = append(data, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))...)
+	data = append(data, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select * from t where id=2"...))...)
+	processRequest(rs, data, time.Now())
+
+	if stats.queries != 2 {
+		t.Errorf("stats.queries = %d, want 2", stats.queries)
+	}
+	if !strings.Contains(rs.qText, "select * from t where id=?") {
+		t.Errorf("qText = %q, want the second query", rs.qText)
+	}
+	if len(rs.reqBuffer) != 0 {
+		t.Errorf("reqBuffer has %d bytes left, want 0", len(rs.reqBuffer))
+	}
+}
+
+func TestProcessRequestKeepsTrailingPartial(t *testing.T) {
+	stats.queries = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	second := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 2"...))
+	data := append(mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), second[:6]...)
+	processRequest(rs, data, time.Now())
+
+	if stats.queries != 1 {
+		t.Errorf("stats.queries = %d, want 1", stats.queries)
+	}
+	if !bytes.Equal(rs.reqBuffer, second[:6]) {
+		t.Errorf("reqBuffer = %v, want the partial packet %v", rs.reqBuffer, second[:6])
+	}
+}
+
+func TestProcessRequestAcrossSegments(t *testing.T) {
+	stats.queries = 0
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	// A 40KB INSERT arriving in three segments, the last of them coalesced
+	// with a small query after it
+	insert := "insert into blobs values ('" + strings.Repeat("x", 40000) + "')"
+	data := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, insert...))
+	data = append(data, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))...)
+
+	processRequest(rs, data[:1460], time.Now())
+	processRequest(rs, data[1460:20000], time.Now())
+	if stats.queries != 0 {
+		t.Fatalf("stats.queries = %d before the INSERT was complete", stats.queries)
+	}
+	processRequest(rs, data[20000:], time.Now())
+
+	if stats.queries != 2 {
+		t.Errorf("stats.queries = %d, want the INSERT and the SELECT", stats.queries)
+	}
+	if rs.qText != "select ?" || len(rs.reqBuffer) != 0 {
+		t.Errorf("qText = %q with %d bytes left over, want the SELECT last and nothing left", rs.qText, len(rs.reqBuffer))
+	}
+}
+
+// ========== prettyPrintQuery Tests ==========
+
+func TestPrettyPrintQuery(t *testing.T) {
+	query := "select a, b from t left outer join u on t.id=u.id where x=? group by a order by b limit ?"
+	want := "select a, b\nfrom t\nleft outer join u on t.id=u.id\nwhere x=?\ngroup by a\norder by b\nlimit ?"
+
+	if got := prettyPrintQuery(query); got != want {
+		t.Errorf("prettyPrintQuery()\n  got:  %q\n  want: %q", got, want)
+	}
+
+	// A column named like a keyword doesn't start a clause on its own
+	if got := prettyPrintQuery("select `order` from t"); got != "select `order`\nfrom t" {
+		t.Errorf("prettyPrintQuery() = %q", got)
+	}
+}
+
+func TestPrettyPrintLeavesKeyUnchanged(t *testing.T) {
+	prettyPrint = true
+	defer func() { prettyPrint = false }()
+	format = nil
+	parseFormat("#q")
+
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1"}
+	key := formatQueryText(rs, []byte("select * from t where id = 1"))
+	if key != "select * from t where id = ?" {
+		t.Errorf("formatQueryText() = %q, want the single-line canonical query", key)
+	}
+}
+
+// ========== isCartesianJoin Tests ==========
+
+func TestIsCartesianJoin(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"select * from users, orders", true},
+		{"select * from users u join orders o", true},
+		{"select * from users u join orders o limit 10", true},
+		{"select * from users, orders where users.id = orders.user_id", false},
+		{"select * from users u join orders o on u.id = o.user_id", false},
+		{"select * from users u join orders o using (user_id)", false},
+		{"select * from users u left join orders o on u.id = o.user_id join items i on i.order_id = o.id", false},
+		{"select * from sizes cross join colors", false},
+		{"select * from (select a, b from t) x", false},
+		{"select count(*) from t", false},
+		{"insert into t values (1, 2)", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := isCartesianJoin([]byte(tt.query)); got != tt.want {
+				t.Errorf("isCartesianJoin(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+// ========== Multi-statement Tests ==========
+
+func TestSplitStatements(t *testing.T) {
+	got := splitStatements([]byte("insert into t values (1); select ';' from t ;"), sqlMode{})
+	want := [][]byte{[]byte("insert into t values (1)"), []byte("select ';' from t")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements() = %q, want %q", got, want)
+	}
+}
+
+func TestDuplicateStatementsInBatch(t *testing.T) {
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	stats.duplicateBatches = 0
+	format = nil
+	parseFormat("#q")
+
+	batch := "update t set n = n + 1 where id = 1; select 1; update t set n = n + 1 where id = 2"
+	dups := duplicateStatements([]byte(batch), sqlMode{})
+	if want := map[string]int{"update t set n = n + ? where id = ?": 2}; !reflect.DeepEqual(dups, want) {
+		t.Errorf("duplicateStatements() = %v, want %v", dups, want)
+	}
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, batch...)), time.Now())
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1; select 2 from t"...)), time.Now())
+	if stats.duplicateBatches != 1 {
+		t.Errorf("stats.duplicateBatches = %d, want 1", stats.duplicateBatches)
+	}
+}
+
+// ========== Unbounded Write Tests ==========
+
+func TestIsUnboundedWrite(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"DELETE FROM t", true},
+		{"UPDATE t SET x = 1", true},
+		{"update t set x = (select max(y) from u where u.id = 1)", true},
+		{"DELETE FROM t WHERE id = 1", false},
+		{"UPDATE t SET x = 1 WHERE id = 2", false},
+		{"DELETE FROM t LIMIT 1000", false},
+		{"UPDATE t JOIN u ON u.id = t.u_id SET t.x = u.x", false},
+		{"TRUNCATE TABLE t", false},
+		{"SELECT * FROM t", false},
+	}
+	for _, tt := range tests {
+		if got := isUnboundedWrite([]byte(tt.query)); got != tt.want {
+			t.Errorf("isUnboundedWrite(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// -n only changes how queries are displayed; the checks still see tokens
+func TestQueryChecksWithNoClean(t *testing.T) {
+	savedVerbose, savedNoclean := verbose, noclean
+	defer func() { verbose, noclean = savedVerbose, savedNoclean }()
+	verbose, noclean = true, true
+
+	if isUnboundedWrite([]byte("DELETE FROM t WHERE id = 5")) {
+		t.Errorf("isUnboundedWrite flagged a DELETE with a WHERE under -v -n")
+	}
+	if !isUnboundedWrite([]byte("DELETE FROM t")) {
+		t.Errorf("isUnboundedWrite missed a DELETE without a WHERE under -v -n")
+	}
+	if !isLockingRead([]byte("SELECT * FROM t WHERE id = 1 FOR UPDATE")) {
+		t.Errorf("isLockingRead missed FOR UPDATE under -v -n")
+	}
+	if !isCartesianJoin([]byte("SELECT * FROM a, b")) {
+		t.Errorf("isCartesianJoin missed a comma join under -v -n")
+	}
+	if !isLoadDataLocal([]byte("LOAD DATA LOCAL INFILE 'x.csv' INTO TABLE t")) {
+		t.Errorf("isLoadDataLocal missed LOAD DATA LOCAL under -v -n")
+	}
+	if got := whereColumns([]byte("SELECT * FROM t WHERE id = 1")); !reflect.DeepEqual(got, []string{"id"}) {
+		t.Errorf("whereColumns() = %v under -v -n, want [id]", got)
+	}
+	if got := duplicateStatements([]byte("SELECT 1; SELECT 1"), sqlMode{}); got["SELECT 1"] != 2 {
+		t.Errorf("duplicateStatements() = %v under -v -n", got)
+	}
+	if _, ok := parseSQLModeSet([]byte("SET sql_mode = 'ANSI_QUOTES'"), sqlMode{}); !ok {
+		t.Errorf("parseSQLModeSet missed SET sql_mode under -v -n")
+	}
+	if cleanupQuery([]byte("SELECT 1")) != "SELECT 1" || cleanupQuery([]byte("DELETE FROM t WHERE id = 5")) != "DELETE FROM t WHERE id = 5" {
+		t.Errorf("cleanupQuery canonicalized under -v -n")
+	}
+}
+
+func TestUnboundedWriteWarning(t *testing.T) {
+	stats.unboundedWrites = 0
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	for _, q := range []string{"DELETE FROM sessions", "DELETE FROM sessions WHERE id = 7", "UPDATE users SET active = 0"} {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+	}
+
+	if stats.unboundedWrites != 2 {
+		t.Errorf("stats.unboundedWrites = %d, want 2", stats.unboundedWrites)
+	}
+	if !strings.Contains(out.String(), "UPDATE/DELETE without WHERE from 10.0.0.1:5000: DELETE FROM sessions") {
+		t.Errorf("missing warning:\n%s", out.String())
+	}
+}
+
+// ========== Replay Tests ==========
+
+// mockExecutor records the queries it is asked to run
+type mockExecutor struct {
+	queries []string
+}
+
+func (m *mockExecutor) Execute(query string) error {
+	m.queries = append(m.queries, query)
+	return nil
+}
+
+func TestReplayReadOnlyGuard(t *testing.T) {
+	exec := &mockExecutor{}
+	r := newReplayer(exec, true, 1.0)
+
+	for _, q := range []string{
+		"SELECT * FROM users WHERE id = 5",
+		"insert into users values (1, 'x')",
+		"UPDATE users SET name = 'y' WHERE id = 1",
+		"delete from users",
+		"drop table users",
+		"show tables",
+	} {
+		r.offer(q)
+	}
+	close(r.queue)
+	r.run()
+
+	want := []string{"SELECT * FROM users WHERE id = 5", "show tables"}
+	if !reflect.DeepEqual(exec.queries, want) {
+		t.Errorf("replayed %q, want %q", exec.queries, want)
+	}
+	if r.skipped.Load() != 4 {
+		t.Errorf("skipped = %d, want 4", r.skipped.Load())
+	}
+	if r.replayed.Load() != 2 {
+		t.Errorf("replayed = %d, want 2", r.replayed.Load())
+	}
+}
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT * FROM users WHERE id = 5", true},
+		{"SELECT * FROM users WHERE note = 'for update into outfile'", true},
+		{"SELECT * FROM users INTO OUTFILE '/tmp/users.csv'", false},
+		{"SELECT data FROM blobs WHERE id = 1 INTO DUMPFILE '/tmp/x'", false},
+		{"SELECT id INTO @id FROM users LIMIT 1", false},
+		{"SELECT * FROM users WHERE id = 5 FOR UPDATE", false},
+		{"select * from users for share", false},
+		{"SELECT * FROM users LOCK IN SHARE MODE", false},
+		{"SELECT * FROM a WHERE id IN (SELECT a_id FROM b FOR UPDATE)", false},
+		{"EXPLAIN SELECT * FROM users", true},
+		{"EXPLAIN ANALYZE SELECT * FROM users", true},
+		{"EXPLAIN ANALYZE FORMAT=TREE SELECT * FROM users", true},
+		{"EXPLAIN ANALYZE UPDATE users SET name = 'x'", false},
+		{"explain analyze delete from users", false},
+		{"EXPLAIN UPDATE users SET name = 'x'", true},
+		{"UPDATE users SET name = 'x'", false},
+	}
+	for _, tt := range tests {
+		if got := isReadOnlyQuery([]byte(tt.query)); got != tt.want {
+			t.Errorf("isReadOnlyQuery(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestReplayStopDrainsQueue(t *testing.T) {
+	exec := &mockExecutor{}
+	r := newReplayer(exec, true, 1.0)
+	r.offer("SELECT 1")
+	r.offer("SELECT 2")
+	go r.run()
+	r.stop()
+
+	if !reflect.DeepEqual(exec.queries, []string{"SELECT 1", "SELECT 2"}) {
+		t.Errorf("replayed %q before stop returned", exec.queries)
+	}
+}
+
+func TestReplayScale(t *testing.T) {
+	exec := &mockExecutor{}
+	r := newReplayer(exec, false, 0.25)
+
+	for i := 0; i < 100; i++ {
+		r.offer("select 1")
+	}
+	close(r.queue)
+	r.run()
+
+	if len(exec.queries) != 25 {
+		t.Errorf("replayed %d of 100 queries at scale 0.25, want 25", len(exec.queries))
+	}
+}
+
+func TestParseReplayDSN(t *testing.T) {
+	addr, user, password, dbName, err := parseReplayDSN("app:s3cr@t@staging:3306/shop")
+	if err != nil {
+		t.Fatalf("parseReplayDSN() error = %v", err)
+	}
+	if addr != "staging:3306" || user != "app" || password != "s3cr@t" || dbName != "shop" {
+		t.Errorf("parseReplayDSN() = %q, %q, %q, %q", addr, user, password, dbName)
+	}
+
+	if _, _, _, _, err := parseReplayDSN("staging:3306"); err == nil {
+		t.Errorf("parseReplayDSN() accepted a DSN without a user")
+	}
+}
+
+// ========== Server Port Tests ==========
+
+func TestParseServerPorts(t *testing.T) {
+	got, err := parseServerPorts("3306, 6033-6034")
+	if err != nil {
+		t.Fatalf("parseServerPorts() error = %v", err)
+	}
+	want := []portRange{{3306, 3306}, {6033, 6034}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseServerPorts() = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"", "abc", "3310-3306", "70000"} {
+		if _, err := parseServerPorts(bad); err == nil {
+			t.Errorf("parseServerPorts(%q) should fail", bad)
+		}
+	}
+}
+
+func TestPacketDirection(t *testing.T) {
+	defer func() {
+		serverPorts = nil
+		lowerPortIsServer = false
+	}()
+
+	tests := []struct {
+		name        string
+		ports       []portRange
+		lowerPort   bool
+		src, dst    uint16
+		wantRequest bool
+		wantOK      bool
+	}{
+		{"default port request", []portRange{{3306, 3306}}, false, 51000, 3306, true, true},
+		{"default port response", []portRange{{3306, 3306}}, false, 3306, 51000, false, true},
+		{"backend port in range", []portRange{{3306, 3306}, {3307, 3310}}, false, 51000, 3308, true, true},
+		{"unknown backend port", []portRange{{3306, 3306}}, false, 51000, 3307, false, false},
+		{"lower port heuristic request", []portRange{{3306, 3306}}, true, 51000, 3307, true, true},
+		{"lower port heuristic response", []portRange{{3306, 3306}}, true, 3307, 51000, false, true},
+		{"proxy to backend, both server ports", []portRange{{3306, 3306}, {6033, 6033}}, true, 6033, 3306, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverPorts = tt.ports
+			lowerPortIsServer = tt.lowerPort
+
+			request, ok := packetDirection(tt.src, tt.dst)
+			if ok != tt.wantOK || (ok && request != tt.wantRequest) {
+				t.Errorf("packetDirection(%d, %d) = %v, %v, want %v, %v",
+					tt.src, tt.dst, request, ok, tt.wantRequest, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCaptureFilter(t *testing.T) {
+	defer func() {
+		serverPorts = nil
+		lowerPortIsServer = false
+	}()
+
+	serverPorts = []portRange{{3306, 3306}, {6033, 6034}}
+	want := `(tcp and (port 3306 or portrange 6033-6034)) or (ip proto \tcp and ip[6:2] & 0x1fff != 0)`
+	if got := captureFilter(); got != want {
+		t.Errorf("captureFilter() = %q, want %q", got, want)
+	}
+
+	// Non-first fragments have no TCP header to match a port on, so they're
+	// let through on the fragment offset alone
+	if !strings.HasSuffix(captureFilter(), " or "+IP_FRAGMENT_FILTER) {
+		t.Errorf("captureFilter() = %q drops non-first fragments", captureFilter())
+	}
+
+	// tcp matches on the IP protocol, which every fragment carries
+	lowerPortIsServer = true
+	if got := captureFilter(); got != "tcp" {
+		t.Errorf("captureFilter() with the lower-port heuristic = %q, want %q", got, "tcp")
+	}
+}
+
+// ========== sql_mode Tests ==========
+
+func TestParseSQLModeSet(t *testing.T) {
+	tests := []struct {
+		query  string
+		want   sqlMode
+		wantOK bool
+	}{
+		{"SET sql_mode='ANSI_QUOTES'", sqlMode{ansiQuotes: true}, true},
+		{"set @@session.sql_mode = 'STRICT_TRANS_TABLES,NO_BACKSLASH_ESCAPES'", sqlMode{noBackslashEscapes: true}, true},
+		{"SET SESSION sql_mode := 'ANSI'", sqlMode{ansiQuotes: true}, true},
+		{"SET NAMES utf8mb4, sql_mode='ANSI_QUOTES'", sqlMode{ansiQuotes: true}, true},
+		{"SET sql_mode=DEFAULT", sqlMode{}, true},
+		{"SET GLOBAL sql_mode='ANSI_QUOTES'", sqlMode{}, false},
+		{"SET sql_mode=CONCAT(@@sql_mode, ',ANSI_QUOTES')", sqlMode{}, false},
+		{"SET autocommit=1", sqlMode{}, false},
+		{"SELECT 'sql_mode=ANSI_QUOTES'", sqlMode{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, ok := parseSQLModeSet([]byte(tt.query), sqlMode{})
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("parseSQLModeSet(%q) = %+v, %v, want %+v, %v", tt.query, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCleanupQueryWithMode(t *testing.T) {
+	query := []byte(`select "foo" from t where a='it\'s'`)
+	if got, want := cleanupQueryWithMode(query, sqlMode{}), "select ? from t where a=?"; got != want {
+		t.Errorf("default mode: got %q, want %q", got, want)
+	}
+	if got, want := cleanupQueryWithMode(query, sqlMode{ansiQuotes: true}), `select "foo" from t where a=?`; got != want {
+		t.Errorf("ANSI_QUOTES: got %q, want %q", got, want)
+	}
+
+	// Without backslash escapes the string ends at the second quote
+	query = []byte(`select 'a\' from t`)
+	if got, want := cleanupQueryWithMode(query, sqlMode{noBackslashEscapes: true}), "select ? from t"; got != want {
+		t.Errorf("NO_BACKSLASH_ESCAPES: got %q, want %q", got, want)
+	}
+}
+
+func TestProcessRequestTracksSQLMode(t *testing.T) {
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	query := func(q string) []byte {
+		return mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...))
+	}
+
+	processRequest(rs, query(`select "foo" from t`), time.Now())
+	if !strings.Contains(rs.qText, "select ? from t") {
+		t.Errorf("before SET: qText = %q, want the string canonicalized", rs.qText)
+	}
+
+	processRequest(rs, query("SET sql_mode='ANSI_QUOTES'"), time.Now())
+	processRequest(rs, query(`select "foo" from t`), time.Now())
+	if !strings.Contains(rs.qText, `select "foo" from t`) {
+		t.Errorf("after SET: qText = %q, want the identifier kept", rs.qText)
+	}
+}
+
+// ========== Buffer Limit Tests ==========
+
+func TestProcessResponseCapsBuffer(t *testing.T) {
+	defer func(old int) { maxBufferSize = old }(maxBufferSize)
+	maxBufferSize = 1024
+	stats.desyncs = 0
+
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	chunk := make([]byte, 600)
+	processResponse(rs, chunk, time.Now())
+	if len(rs.respBuffer) != 600 || stats.desyncs != 0 {
+		t.Fatalf("under the cap: buffered %d bytes with %d desyncs, want 600 and 0", len(rs.respBuffer), stats.desyncs)
+	}
+
+	processResponse(rs, chunk, time.Now())
+	if rs.respBuffer != nil {
+		t.Errorf("respBuffer holds %d bytes, want it dropped", len(rs.respBuffer))
+	}
+	if stats.desyncs != 1 || rs.synced {
+		t.Errorf("desyncs = %d, synced = %v, want 1 and false", stats.desyncs, rs.synced)
+	}
+}
+
+func TestProcessRequestCapsBuffer(t *testing.T) {
+	defer func(old int) { maxBufferSize = old }(maxBufferSize)
+	maxBufferSize = 1024
+	stats.desyncs = 0
+
+	// A header promising a packet far bigger than the cap
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	big := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, make([]byte, 4096)...))
+	processRequest(rs, big[:600], time.Now())
+	processRequest(rs, big[600:1200], time.Now())
+
+	if rs.reqBuffer != nil {
+		t.Errorf("reqBuffer holds %d bytes, want it dropped", len(rs.reqBuffer))
+	}
+	if stats.desyncs != 1 || rs.synced {
+		t.Errorf("desyncs = %d, synced = %v, want 1 and false", stats.desyncs, rs.synced)
+	}
+}
+
+// ========== COM_RESET_CONNECTION Tests ==========
+
+func TestResetConnectionClearsSessionState(t *testing.T) {
+	format = nil
+	parseFormat("#q")
+	stats.queries = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "SET sql_mode='ANSI_QUOTES,NO_BACKSLASH_ESCAPES'"...)), time.Now())
+	processResponse(rs, ok, time.Now())
+	if !rs.sqlMode.ansiQuotes {
+		t.Fatalf("sql_mode not tracked before the reset")
+	}
+
+	processRequest(rs, mysqlPacket(0, []byte{mysql.COM_RESET_CONNECTION}), time.Now())
+	processResponse(rs, ok, time.Now())
+
+	if rs.sqlMode != (sqlMode{}) {
+		t.Errorf("sqlMode = %+v after COM_RESET_CONNECTION, want the default", rs.sqlMode)
+	}
+	if !rs.synced {
+		t.Errorf("stream lost sync on COM_RESET_CONNECTION")
+	}
+	if stats.queries != 1 {
+		t.Errorf("stats.queries = %d, want 1 kept across the reset", stats.queries)
+	}
+
+	// Double quotes are strings again
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, `select "foo"`...)), time.Now())
+	if !strings.Contains(rs.qText, "select ?") {
+		t.Errorf("qText = %q after reset, want the string canonicalized", rs.qText)
+	}
+}
+
+// ========== Keep Booleans Tests ==========
+
+func TestCleanupQueryKeepBooleans(t *testing.T) {
+	defer func() { keepBooleans = false }()
+	keepBooleans = true
+
+	active0 := cleanupQuery([]byte("select * from users where active = 0"))
+	active1 := cleanupQuery([]byte("select * from users where active = 1"))
+	if active0 == active1 {
+		t.Errorf("active = 0 and active = 1 both canonicalized to %q", active0)
+	}
+
+	id5 := cleanupQuery([]byte("select * from users where id = 5"))
+	id6 := cleanupQuery([]byte("select * from users where id = 6"))
+	if id5 != id6 || id5 != "select * from users where id = ?" {
+		t.Errorf("id = 5 -> %q, id = 6 -> %q, want both %q", id5, id6, "select * from users where id = ?")
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"select * from t where flag = TRUE", "select * from t where flag = TRUE"},
+		{"select * from t where x = 1.5", "select * from t where x = ?.?"},
+		{"select * from t where x = 0x1f", "select * from t where x = ?x1f"},
+		{"select * from t where x = 10", "select * from t where x = ?"},
+	}
+	for _, tt := range tests {
+		if got := cleanupQuery([]byte(tt.query)); got != tt.want {
+			t.Errorf("cleanupQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	keepBooleans = false
+	if got := cleanupQuery([]byte("select * from users where active = 1")); got != "select * from users where active = ?" {
+		t.Errorf("without the flag: got %q", got)
+	}
+}
+
+// ========== Operator Spacing Tests ==========
+
+func TestCleanupQueryNormalizeOperatorSpacing(t *testing.T) {
+	defer func() { normalizeOperators = false }()
+
+	if cleanupQuery([]byte("select * from t where id=1")) == cleanupQuery([]byte("select * from t where id = 1")) {
+		t.Fatalf("spacing already merged without the flag")
+	}
+
+	normalizeOperators = true
+	want := "select * from t where id = ?"
+	for _, query := range []string{
+		"select * from t where id=1",
+		"select * from t where id =1",
+		"select * from t where id= 1",
+		"select * from t where id = 1",
+	} {
+		if got := cleanupQuery([]byte(query)); got != want {
+			t.Errorf("cleanupQuery(%q) = %q, want %q", query, got, want)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"select * from t where a>=1 and b<>2", "select * from t where a >= ? and b <> ?"},
+		{"select * from t where a<=>b", "select * from t where a <=> b"},
+		{"select * from t where id=-1", "select * from t where id = -?"},
+		{"select * from t where id = - 1", "select * from t where id = -?"},
+		{"select a-1 from t", "select a - ? from t"},
+		{"select a -1 from t", "select a - ? from t"},
+		{"select * from t where x in (-1, 2)", "select * from t where x in (-?)"},
+	}
+	for _, tt := range tests {
+		if got := cleanupQuery([]byte(tt.query)); got != tt.want {
+			t.Errorf("cleanupQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// ========== Ignore Ordering Tests ==========
+
+func TestCleanupQueryIgnoreOrdering(t *testing.T) {
+	defer func() { ignoreOrdering = false }()
+	a := "SELECT * FROM t WHERE x = 1 ORDER BY a LIMIT 10"
+	b := "SELECT * FROM t WHERE x = 2 ORDER BY b DESC LIMIT 20 OFFSET 40"
+	if cleanupQuery([]byte(a)) == cleanupQuery([]byte(b)) {
+		t.Fatalf("ordering variants merged without the flag")
+	}
+
+	ignoreOrdering = true
+	want := "SELECT * FROM t WHERE x = ?"
+	for _, query := range []string{a, b, "SELECT * FROM t WHERE x = 3 LIMIT 5", "SELECT * FROM t WHERE x = 4"} {
+		if got := cleanupQuery([]byte(query)); got != want {
+			t.Errorf("cleanupQuery(%q) = %q, want %q", query, got, want)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM t WHERE id = 1 ORDER BY id LIMIT 1 FOR UPDATE", "SELECT * FROM t WHERE id = ? FOR UPDATE"},
+		{"SELECT * FROM t WHERE id IN (SELECT id FROM u ORDER BY n LIMIT 5)", "SELECT * FROM t WHERE id IN (SELECT id FROM u ORDER BY n LIMIT ?)"},
+		{"SELECT a, RANK() OVER (ORDER BY b) FROM t ORDER BY a", "SELECT a RANK() OVER (ORDER BY b) FROM t"},
+	}
+	for _, tt := range tests {
+		if got := cleanupQuery([]byte(tt.query)); got != tt.want {
+			t.Errorf("cleanupQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// ========== Retransmission Tests ==========
+
+// tcpPacket builds a decoded client-to-server IPv4/TCP packet carrying payload
+func tcpPacket(t *testing.T, seq uint32, payload []byte) gopacket.Packet {
+	return tcpSegment(t, 51000, true, false, seq, payload)
+}
+
+// tcpSegment builds a decoded IPv4/TCP packet between 10.0.0.1:clientPort and
+// 10.0.0.2:3306, in either direction, optionally with SYN set
+func tcpSegment(t *testing.T, clientPort uint16, fromClient, syn bool, seq uint32, payload []byte) gopacket.Packet {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(clientPort), DstPort: 3306, Seq: seq, PSH: !syn, Window: 65535}
+	if !fromClient {
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	tcp.SYN = syn
+	tcp.ACK = !syn || !fromClient
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+func TestSeqTrackerAccept(t *testing.T) {
+	var tr seqTracker
+	if got, re := tr.accept(100, []byte("abcd")); string(got) != "abcd" || re {
+		t.Errorf("first segment: got %q, %v", got, re)
+	}
+	if got, re := tr.accept(100, []byte("abcd")); got != nil || !re {
+		t.Errorf("full retransmit: got %q, %v, want nil, true", got, re)
+	}
+	if got, re := tr.accept(102, []byte("cdef")); string(got) != "ef" || !re {
+		t.Errorf("overlapping retransmit: got %q, %v, want \"ef\", true", got, re)
+	}
+	if got, re := tr.accept(106, []byte("gh")); string(got) != "gh" || re {
+		t.Errorf("next segment: got %q, %v, want \"gh\", false", got, re)
+	}
+
+	// Sequence numbers wrap around
+	tr = seqTracker{}
+	tr.accept(math.MaxUint32-1, []byte("ab"))
+	if got, re := tr.accept(0, []byte("cd")); string(got) != "cd" || re {
+		t.Errorf("after wraparound: got %q, %v, want \"cd\", false", got, re)
+	}
+	if _, re := tr.accept(math.MaxUint32-1, []byte("ab")); !re {
+		t.Errorf("retransmit across wraparound not detected")
+	}
+}
+
+func TestHandlePacketRetransmit(t *testing.T) {
+	defer func() { serverPorts = nil }()
+	serverPorts = []portRange{{3306, 3306}}
+	chmap = make(map[string]*source)
+	stats.queries = 0
+	stats.retransmits = 0
+
+	query := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))
+	handlePacket(tcpPacket(t, 1000, query))
+	handlePacket(tcpPacket(t, 1000, query))
+
+	if stats.queries != 1 {
+		t.Errorf("stats.queries = %d, want the retransmitted query counted once", stats.queries)
+	}
+	if stats.retransmits != 1 {
+		t.Errorf("stats.retransmits = %d, want 1", stats.retransmits)
+	}
+	if rs := chmap["10.0.0.1:51000"]; rs == nil || rs.retransmits != 1 {
+		t.Errorf("per-source retransmits not counted: %+v", rs)
+	}
+}
+
+func TestHandlePacketDuplicateResponseSegment(t *testing.T) {
+	defer func() { serverPorts = nil }()
+	serverPorts = []portRange{{3306, 3306}}
+	chmap = make(map[string]*source)
+	stats.retransmits = 0
+	stats.desyncs = 0
+	format = nil
+	parseFormat("#q")
+
+	var resp []byte
+	resp = append(resp, mysqlPacket(1, []byte{0x01})...)
+	resp = append(resp, mysqlPacket(2, columnDefPacket("n", mysql.MYSQL_TYPE_LONGLONG))...)
+	resp = append(resp, mysqlPacket(3, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})...)
+	resp = append(resp, mysqlPacket(4, []byte("\x011"))...)
+	resp = append(resp, mysqlPacket(5, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})...)
+
+	handlePacket(tcpPacket(t, 1000, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))))
+	rs := chmap["10.0.0.1:51000"]
+
+	// The first half of the result set arrives twice; appending it again
+	// would corrupt the buffered response
+	half := 20
+	handlePacket(tcpSegment(t, 51000, false, false, 5000, resp[:half]))
+	handlePacket(tcpSegment(t, 51000, false, false, 5000, resp[:half]))
+	if len(rs.respBuffer) != half {
+		t.Fatalf("respBuffer holds %d bytes after the duplicate, want %d", len(rs.respBuffer), half)
+	}
+	handlePacket(tcpSegment(t, 51000, false, false, 5000+uint32(half), resp[half:]))
+
+	if rs.reqSent != nil || rs.respBuffer != nil {
+		t.Errorf("response not completed cleanly: in flight = %v, %d bytes left", rs.reqSent != nil, len(rs.respBuffer))
+	}
+	if stats.retransmits != 1 || stats.desyncs != 0 {
+		t.Errorf("retransmits = %d, desyncs = %d, want 1, 0", stats.retransmits, stats.desyncs)
+	}
+}
+
+// ========== IP Fragment Tests ==========
+
+func TestHandlePacketFragmentedDatagram(t *testing.T) {
+	defer func() { serverPorts = nil }()
+	serverPorts = []portRange{{3306, 3306}}
+	chmap = make(map[string]*source)
+	stats.queries = 0
+	format = nil
+	parseFormat("#q")
+
+	query := "select * from orders where note = '" + strings.Repeat("x", 200) + "'"
+	whole := tcpPacket(t, 1000, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, query...)))
+	ip := whole.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+
+	// Split the TCP segment across two fragments; offsets count 8 bytes
+	fragment := func(offset int, data []byte, more bool) gopacket.Packet {
+		frag := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, Id: 77,
+			SrcIP: ip.SrcIP, DstIP: ip.DstIP, FragOffset: uint16(offset / 8)}
+		if more {
+			frag.Flags = layers.IPv4MoreFragments
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, frag, gopacket.Payload(data)); err != nil {
+			t.Fatalf("SerializeLayers: %v", err)
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	}
+	handlePacket(fragment(0, ip.Payload[:120], true))
+	if stats.queries != 0 {
+		t.Fatalf("stats.queries = %d after the first fragment, want 0", stats.queries)
+	}
+	handlePacket(fragment(120, ip.Payload[120:], false))
+
+	if stats.queries != 1 {
+		t.Errorf("stats.queries = %d, want the reassembled query counted", stats.queries)
+	}
+	if rs := chmap["10.0.0.1:51000"]; rs == nil || !strings.Contains(rs.qText, "where note = ?") {
+		t.Errorf("reassembled query not processed: %+v", rs)
+	}
+}
+
+// ========== Watch File Tests ==========
+
+func TestWatchFile(t *testing.T) {
+	defer func() { watch = nil }()
+	path := t.TempDir() + "/watch.txt"
+	contents := "# expensive queries\n\nselect * from orders where customer_id = 42\nselect count(*) from audit_log\n"
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := loadWatchList(path, nil)
+	if err != nil {
+		t.Fatalf("loadWatchList: %v", err)
+	}
+	if len(w.queries) != 2 {
+		t.Fatalf("loaded %d queries, want 2: %q", len(w.queries), w.queries)
+	}
+	watch = w
+
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select * from orders where customer_id = 7"...)), time.Now())
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select * from users"...)), time.Now())
+
+	if got := watch.counts["select * from orders where customer_id = ?"]; got != 1 {
+		t.Errorf("watched query count = %d, want 1", got)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	watch.report()
+	if !strings.Contains(out.String(), "       1  select * from orders where customer_id = ?") ||
+		!strings.Contains(out.String(), "       0  select count(*) from audit_log") {
+		t.Errorf("watched section missing entries:\n%s", out.String())
+	}
+
+	// Reloading keeps the counts of queries still listed
+	if err := os.WriteFile(path, []byte("select * from orders where customer_id = 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err = loadWatchList(path, watch)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if len(w.queries) != 1 || w.counts["select * from orders where customer_id = ?"] != 1 {
+		t.Errorf("after reload: queries %q, counts %v", w.queries, w.counts)
+	}
+}
+
+func TestWatchReportEscapesQuery(t *testing.T) {
+	w := &watchList{path: "watch.txt", queries: []string{"select \x1b[2Jboom"}, counts: map[string]uint64{"select \x1b[2Jboom": 3}}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	w.report()
+	if strings.Contains(out.String(), "\x1b") || !strings.Contains(out.String(), "       3  "+escapeControlBytes("select \x1b[2Jboom")) {
+		t.Errorf("watched query printed unescaped:\n%q", out.String())
+	}
+}
+
+// ========== Sample Slow Tests ==========
+
+func TestSampleSlowShowsOnlySlowQueries(t *testing.T) {
+	defer func() { slowThreshold = 0 }()
+	out := captureVerbose(t)
+	verbose = false
+	slowThreshold = 100 * time.Millisecond
+	stats.slowQueries = 0
+
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	rs.qText = "select fast"
+	now := time.Now()
+	rs.reqSent = &now
+	processResponse(rs, ok, time.Now())
+	if strings.Contains(out.String(), "select fast") {
+		t.Errorf("fast query was shown in detail:\n%s", out.String())
+	}
+
+	rs.qText = "select slow"
+	then := time.Now().Add(-time.Second)
+	rs.reqSent = &then
+	processResponse(rs, ok, time.Now())
+	if !strings.Contains(out.String(), "select slow") {
+		t.Errorf("slow query was not shown in detail:\n%s", out.String())
+	}
+	if stats.slowQueries != 1 {
+		t.Errorf("stats.slowQueries = %d, want 1", stats.slowQueries)
+	}
+}
+
+// ========== LOAD DATA LOCAL Tests ==========
+
+func TestIsLoadDataLocal(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"LOAD DATA LOCAL INFILE '/tmp/x.csv' INTO TABLE t", true},
+		{"load data low_priority local infile 'x' into table t", true},
+		{"LOAD XML LOCAL INFILE 'x.xml' INTO TABLE t", true},
+		{"LOAD DATA INFILE '/var/lib/mysql-files/x.csv' INTO TABLE t", false},
+		{"SELECT 'LOAD DATA LOCAL'", false},
+	}
+	for _, tt := range tests {
+		if got := isLoadDataLocal([]byte(tt.query)); got != tt.want {
+			t.Errorf("isLoadDataLocal(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestLocalInfileDisabledCounted(t *testing.T) {
+	stats.localInfileDisabled = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	errPacket := func(code uint16, msg string) []byte {
+		payload := []byte{0xff, byte(code), byte(code >> 8), '#', '4', '2', '0', '0', '0'}
+		return mysqlPacket(1, append(payload, msg...))
+	}
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "LOAD DATA LOCAL INFILE 'x.csv' INTO TABLE t"...)), time.Now())
+	processResponse(rs, errPacket(ER_CLIENT_LOCAL_FILES_DISABLED, "Loading local data is disabled"), time.Now())
+	if stats.localInfileDisabled != 1 {
+		t.Errorf("stats.localInfileDisabled = %d, want 1", stats.localInfileDisabled)
+	}
+
+	// Older servers send 1148 instead
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "LOAD DATA LOCAL INFILE 'x.csv' INTO TABLE t"...)), time.Now())
+	processResponse(rs, errPacket(ER_NOT_ALLOWED_COMMAND, "The used command is not allowed with this MySQL version"), time.Now())
+	if stats.localInfileDisabled != 2 {
+		t.Errorf("stats.localInfileDisabled = %d, want 2", stats.localInfileDisabled)
+	}
+
+	// The same error on another query is just an error
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), time.Now())
+	processResponse(rs, errPacket(ER_NOT_ALLOWED_COMMAND, "The used command is not allowed with this MySQL version"), time.Now())
+	if stats.localInfileDisabled != 2 {
+		t.Errorf("stats.localInfileDisabled = %d after an unrelated error, want 2", stats.localInfileDisabled)
+	}
+}
+
+func TestLocalInfileTerminatorOutsideExchange(t *testing.T) {
+	format = nil
+	parseFormat("#q")
+	stats.queries = 0
+	stats.desyncs = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	// carvePacket consumes an empty packet on its own
+	buf := append(mysqlPacket(4, nil), 0x01)
+	if _, _, err := carvePacket(&buf); !errors.Is(err, errEmptyPacket) || !bytes.Equal(buf, []byte{0x01}) {
+		t.Errorf("carvePacket(empty packet) = %v leaving %#v, want errEmptyPacket leaving one byte", err, buf)
+	}
+
+	// The end of a file whose LOCAL INFILE request we didn't follow, in a
+	// segment of its own, must not swallow the next command
+	processRequest(rs, mysqlPacket(4, nil), time.Now())
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), time.Now())
+	if stats.queries != 1 || rs.reqSent == nil {
+		t.Fatalf("query after the terminator: queries = %d, in flight = %v", stats.queries, rs.reqSent != nil)
+	}
+
+	processResponse(rs, mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), time.Now())
+	if rs.reqSent != nil || rs.respBuffer != nil || !rs.synced || stats.desyncs != 0 {
+		t.Errorf("after the OK: in flight = %v, synced = %v, desyncs = %d", rs.reqSent != nil, rs.synced, stats.desyncs)
+	}
+}
+
+// ========== Row Display Limit Tests ==========
+
+func TestRowDisplayLimits(t *testing.T) {
+	defer func() { maxColumnsDisplayed, maxValueWidth = 0, 0 }()
+	maxColumnsDisplayed = 3
+	maxValueWidth = 4
+
+	packets := [][]byte{{10}}
+	var row []byte
+	for i := 1; i <= 10; i++ {
+		packets = append(packets, columnDefPacket(fmt.Sprintf("c%d", i), mysql.MYSQL_TYPE_VAR_STRING))
+		val := fmt.Sprintf("v%d", i)
+		if i == 1 {
+			val = "héllo wörld"
+		}
+		row = append(row, byte(len(val)))
+		row = append(row, val...)
+	}
+	packets = append(packets, []byte{0xfe, 0x00, 0x00, 0x02, 0x00}, row, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})
+
+	result := parseResultSetFull(packets, mysql.CLIENT_PROTOCOL_41, true, "")
+	if !strings.Contains(result, "c3"+COLOR_DEFAULT+"=") || strings.Contains(result, "c4"+COLOR_DEFAULT+"=") {
+		t.Errorf("want exactly the first 3 columns shown: %q", result)
+	}
+	if !strings.Contains(result, "…(+7 more)") {
+		t.Errorf("missing the more-marker: %q", result)
+	}
+	if !strings.Contains(result, COLOR_WHITE+"héll…"+COLOR_DEFAULT) {
+		t.Errorf("value not truncated to 4 characters: %q", result)
+	}
+}
+
+func TestTruncateValue(t *testing.T) {
+	tests := []struct {
+		val   string
+		width int
+		want  string
+	}{
+		{"abcdef", 0, "abcdef"},
+		{"abcdef", 6, "abcdef"},
+		{"abcdef", 3, "abc…"},
+		{"日本語テキスト", 2, "日本…"},
+	}
+	for _, tt := range tests {
+		if got := truncateValue(tt.val, tt.width); got != tt.want {
+			t.Errorf("truncateValue(%q, %d) = %q, want %q", tt.val, tt.width, got, tt.want)
+		}
+	}
+}
+
+// ========== Strict Sync Tests ==========
+
+func TestStrictSync(t *testing.T) {
+	defer func() {
+		serverPorts = nil
+		strictSync = false
+	}()
+	serverPorts = []portRange{{3306, 3306}}
+	strictSync = true
+	chmap = make(map[string]*source)
+	stats.queries = 0
+	stats.skippedUnvalidated = 0
+
+	greeting := mysqlPacket(0, append([]byte{0x0a}, "8.0.36\x00"...))
+	handshake := mysqlPacket(1, pluginHandshakeResponse("caching_sha2_password"))
+	ok := mysqlPacket(2, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+	query := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))
+
+	// Seen from the SYN, through auth: counted
+	handlePacket(tcpSegment(t, 51000, true, true, 1000, nil))
+	handlePacket(tcpSegment(t, 51000, false, true, 5000, nil))
+	handlePacket(tcpSegment(t, 51000, false, false, 5001, greeting))
+	handlePacket(tcpSegment(t, 51000, true, false, 1001, handshake))
+	handlePacket(tcpSegment(t, 51000, false, false, 5001+uint32(len(greeting)), ok))
+	handlePacket(tcpSegment(t, 51000, true, false, 1001+uint32(len(handshake)), query))
+
+	if stats.queries != 1 || stats.skippedUnvalidated != 0 {
+		t.Fatalf("validated stream: queries = %d, skipped = %d, want 1 and 0", stats.queries, stats.skippedUnvalidated)
+	}
+
+	// Joined mid-stream: skipped, and counted as skipped once
+	handlePacket(tcpSegment(t, 52000, true, false, 7000, query))
+	handlePacket(tcpSegment(t, 52000, true, false, 7000+uint32(len(query)), query))
+
+	if stats.queries != 1 {
+		t.Errorf("mid-join stream: queries = %d, want 1", stats.queries)
+	}
+	if stats.skippedUnvalidated != 1 {
+		t.Errorf("skippedUnvalidated = %d, want 1", stats.skippedUnvalidated)
+	}
+
+	// A lost segment disqualifies a validated stream
+	handlePacket(tcpSegment(t, 51000, true, false, 9999, query))
+	if stats.queries != 1 || stats.skippedUnvalidated != 2 {
+		t.Errorf("after a gap: queries = %d, skipped = %d, want 1 and 2", stats.queries, stats.skippedUnvalidated)
+	}
+}
+
+// ========== Connection Attribute Tests ==========
+
+func TestParseHandshakeConnectAttrs(t *testing.T) {
+	caps := mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_PLUGIN_AUTH | mysql.CLIENT_CONNECT_ATTRS
+	lenenc := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+
+	var block []byte
+	block = append(block, lenenc("_client_name")...)
+	block = append(block, lenenc("libmysql")...)
+	block = append(block, lenenc("program_name")...)
+	block = append(block, lenenc("billing-api")...)
+
+	payload := handshakeResponsePayload(caps)
+	payload = append(payload, "caching_sha2_password\x00"...)
+	payload = append(payload, byte(len(block)))
+	payload = append(payload, block...)
+
+	hs, ok := parseHandshakeResponse(payload)
+	if !ok {
+		t.Fatalf("parseHandshakeResponse() did not recognize the handshake response")
+	}
+	if hs.plugin != "caching_sha2_password" {
+		t.Errorf("plugin = %q, want caching_sha2_password", hs.plugin)
+	}
+	want := map[string]string{"_client_name": "libmysql", "program_name": "billing-api"}
+	if !reflect.DeepEqual(hs.attrs, want) {
+		t.Errorf("attrs = %v, want %v", hs.attrs, want)
+	}
+
+	// Queries on the connection are grouped by the chosen attribute
+	defer func() {
+		attrGroupBy = ""
+		attrCounts = make(map[string]uint64)
+	}()
+	attrGroupBy = "program_name"
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1"}
+	processRequest(rs, mysqlPacket(1, payload), time.Now())
+	processResponse(rs, mysqlPacket(2, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), time.Now())
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), time.Now())
+	if attrCounts["billing-api"] != 1 {
+		t.Errorf("attrCounts = %v, want billing-api counted once", attrCounts)
+	}
+}
+
+func TestAttrGroupByClientVersion(t *testing.T) {
+	defer func() {
+		attrGroupBy = ""
+		attrCounts = make(map[string]uint64)
+		attrLatency = make(map[string]uint64)
+		attrTimed = make(map[string]uint64)
+	}()
+	attrGroupBy = "_client_version"
+	attrCounts = make(map[string]uint64)
+	attrLatency = make(map[string]uint64)
+	attrTimed = make(map[string]uint64)
+	format = nil
+	parseFormat("#q")
+
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+	query := func(rs *source, took time.Duration) {
+		sent := time.Now()
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), sent)
+		processResponse(rs, ok, sent.Add(took))
+	}
+
+	oldApp := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true, attrs: map[string]string{"_client_version": "8.0.36"}}
+	newApp := &source{hostPort: "10.0.0.2:5000", srcIP: "10.0.0.2", synced: true, attrs: map[string]string{"_client_version": "8.4.0"}}
+	joined := &source{hostPort: "10.0.0.3:5000", srcIP: "10.0.0.3", synced: true}
+	query(oldApp, 2*time.Millisecond)
+	query(oldApp, 4*time.Millisecond)
+	query(newApp, 10*time.Millisecond)
+	query(joined, time.Millisecond)
+
+	wantCounts := map[string]uint64{"8.0.36": 2, "8.4.0": 1, "(unknown)": 1}
+	if !reflect.DeepEqual(attrCounts, wantCounts) {
+		t.Errorf("attrCounts = %v, want %v", attrCounts, wantCounts)
+	}
+	wantLatency := map[string]uint64{
+		"8.0.36":    uint64(6 * time.Millisecond),
+		"8.4.0":     uint64(10 * time.Millisecond),
+		"(unknown)": uint64(time.Millisecond),
+	}
+	if !reflect.DeepEqual(attrLatency, wantLatency) {
+		t.Errorf("attrLatency = %v, want %v", attrLatency, wantLatency)
+	}
+	if attrTimed["8.0.36"] != 2 {
+		t.Errorf("attrTimed = %v, want both 8.0.36 queries timed", attrTimed)
+	}
+}
+
+// ========== UTF-8 Tests ==========
+
+func TestCleanupQueryUTF8(t *testing.T) {
+	cleanupHelper(t, "select 名前 from ユーザー where 年齢 = 30", "select 名前 from ユーザー where 年齢 = ?")
+	cleanupHelper(t, "select * from t where name = 'こんにちは'", "select * from t where name = ?")
+	cleanupHelper(t, "select café_id from t", "select café_id from t")
+
+	length, toktype := scanToken([]byte("テーブル1 x"))
+	if toktype != TOKEN_WORD || length != len("テーブル1") {
+		t.Errorf("scanToken(UTF-8 identifier) = %d, %d, want %d, TOKEN_WORD", length, toktype, len("テーブル1"))
+	}
+
+	// Bytes that aren't valid UTF-8 stay single-byte tokens
+	length, toktype = scanToken([]byte{0xff, 0xfe, 'a'})
+	if toktype != TOKEN_OTHER || length != 1 {
+		t.Errorf("scanToken(invalid UTF-8) = %d, %d, want 1, TOKEN_OTHER", length, toktype)
+	}
+}
+
+// ========== EOF Packet Tests ==========
+
+func TestParseIntermediateEOF(t *testing.T) {
+	status := mysql.SERVER_STATUS_AUTOCOMMIT | mysql.SERVER_STATUS_NO_INDEX_USED
+	intermediate := []byte{0xfe, 0x01, 0x00, byte(status), byte(status >> 8)}
+
+	eof, ok := parseEOFPacket(intermediate)
+	if !ok {
+		t.Fatalf("parseEOFPacket() rejected an EOF packet")
+	}
+	if eof.warnings != 1 || eof.statusFlags != status {
+		t.Errorf("parseEOFPacket() = %+v, want 1 warning and flags %#x", eof, status)
+	}
+
+	packets := [][]byte{
+		{0x01},
+		columnDefPacket("id", mysql.MYSQL_TYPE_LONG),
+		intermediate,
+		[]byte("\x011"),
+		{0xfe, 0x00, 0x00, 0x02, 0x00},
+	}
+	result := parseResultSetFull(packets, mysql.CLIENT_PROTOCOL_41, false, "")
+	if !strings.Contains(result, "no index used") || !strings.Contains(result, "1 warning(s)") {
+		t.Errorf("result set header missing the intermediate EOF notes: %q", result)
+	}
+
+	if _, ok := parseEOFPacket([]byte{0x00, 0x00, 0x00}); ok {
+		t.Errorf("parseEOFPacket() accepted an OK packet")
+	}
+}
+
+// ========== Privilege Dropping Tests ==========
+
+func TestLookupUserIDs(t *testing.T) {
+	uid, gid, err := lookupUserIDs("root")
+	if err != nil {
+		t.Skipf("no root user to look up: %v", err)
+	}
+	if uid != 0 || gid != 0 {
+		t.Errorf("lookupUserIDs(root) = %d, %d, want 0, 0", uid, gid)
+	}
+
+	// A numeric uid works as well as a name
+	if uid, _, err := lookupUserIDs("0"); err != nil || uid != 0 {
+		t.Errorf("lookupUserIDs(\"0\") = %d, %v, want 0, nil", uid, err)
+	}
+
+	if _, _, err := lookupUserIDs("no-such-user-for-mysql-sniffer"); err == nil {
+		t.Errorf("lookupUserIDs() found a user that doesn't exist")
+	}
+}
+
+// ========== Proxy Hint Tests ==========
+
+func TestCleanupQueryStripsProxyHints(t *testing.T) {
+	plain := cleanupQuery([]byte("SELECT * FROM orders WHERE id = 1"))
+	for _, query := range []string{
+		"SELECT /* ;hostgroup=2 */ * FROM orders WHERE id = 1",
+		"/*+ ;hostgroup=1;max_lag_ms=500 */ SELECT * FROM orders WHERE id = 1",
+		"SELECT * FROM orders WHERE id = 1 -- maxscale route to master",
+		"/* maxscale route to server db2 */ SELECT * FROM orders WHERE id = 1",
+		"SELECT * FROM orders WHERE id = 1 # maxscale route to slave",
+	} {
+		if got := cleanupQuery([]byte(query)); got != plain {
+			t.Errorf("cleanupQuery(%q) = %q, want %q", query, got, plain)
+		}
+	}
+
+	// Ordinary comments and hint-like strings are not proxy hints
+	cleanupHelper(t, "SELECT /* checkout page */ * FROM t", "SELECT /* checkout page */ * FROM t")
+	cleanupHelper(t, "SELECT '/* hostgroup=1 */' FROM t", "SELECT ? FROM t")
+}
+
+// ========== Locking Read Tests ==========
+
+func TestIsLockingRead(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT * FROM accounts WHERE id = 1 FOR UPDATE", true},
+		{"select balance from accounts where id = 1 for share nowait", true},
+		{"SELECT * FROM t WHERE id = 1 LOCK IN SHARE MODE", true},
+		{"SELECT * FROM accounts WHERE id = 1", false},
+		{"SELECT 'FOR UPDATE' FROM t", false},
+		{"INSERT INTO t SELECT * FROM s FOR UPDATE", false},
+		{"SELECT * FROM (SELECT id FROM t FOR UPDATE) x", false},
+	}
+	for _, tt := range tests {
+		if got := isLockingRead([]byte(tt.query)); got != tt.want {
+			t.Errorf("isLockingRead(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestLockingOnly(t *testing.T) {
+	defer func() { lockingOnly = false }()
+	lockingOnly = true
+	format = nil
+	parseFormat("#q")
+	stats.queries = 0
+	stats.lockingReads = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "SELECT * FROM t WHERE id = 1"...)), time.Now())
+	if stats.queries != 0 || rs.qText != "" {
+		t.Errorf("plain SELECT: queries = %d, qText = %q, want it left out", stats.queries, rs.qText)
+	}
+	if rs.reqSent == nil {
+		t.Errorf("plain SELECT not paired with its response")
+	}
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "SELECT * FROM t WHERE id = 1 FOR UPDATE"...)), time.Now())
+	if stats.queries != 1 || stats.lockingReads != 1 {
+		t.Errorf("locking read: queries = %d, lockingReads = %d, want 1 and 1", stats.queries, stats.lockingReads)
+	}
+	if !strings.Contains(rs.qText, "[locking read]") {
+		t.Errorf("qText = %q, want it tagged as a locking read", rs.qText)
+	}
+}
+
+// ========== Capture Timestamp Tests ==========
+
+func TestLatencyFromCaptureTimestamps(t *testing.T) {
+	defer func() { slowThreshold = 0 }()
+	out := captureVerbose(t)
+	verbose = false
+	slowThreshold = time.Millisecond
+	stats.slowQueries = 0
+
+	// A capture from long ago: the latency is the gap between the packets,
+	// however long ago they were and however fast we process them
+	reqTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	respTime := reqTime.Add(250 * time.Millisecond)
+
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select sleep(0.25)"...)), reqTime)
+	processResponse(rs, mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), respTime)
+
+	if !strings.Contains(out.String(), "250.00ms") {
+		t.Errorf("latency not taken from capture timestamps:\n%s", out.String())
+	}
+	if stats.slowQueries != 1 {
+		t.Errorf("stats.slowQueries = %d, want 1", stats.slowQueries)
+	}
+}
+
+// ========== Response State Machine Tests ==========
+
+func TestResponseMachineMultipleResults(t *testing.T) {
+	caps := uint32(mysql.CLIENT_PROTOCOL_41)
+	more := mysql.SERVER_MORE_RESULTS_EXISTS | mysql.SERVER_STATUS_AUTOCOMMIT
+
+	// A result set announcing another result, then a final OK (as a CALL returns)
+	var resp []byte
+	resp = append(resp, mysqlPacket(1, []byte{0x01})...)
+	resp = append(resp, mysqlPacket(2, columnDefPacket("id", mysql.MYSQL_TYPE_LONG))...)
+	resp = append(resp, mysqlPacket(3, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})...)
+	resp = append(resp, mysqlPacket(4, []byte("\x011"))...)
+	resp = append(resp, mysqlPacket(5, []byte{0xfe, 0x00, 0x00, byte(more), byte(more >> 8)})...)
+	final := mysqlPacket(6, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+
+	var m responseMachine
+	if m.feed(resp, caps) {
+		t.Fatalf("response complete before the announced result arrived")
+	}
+	if m.state != respMoreResults {
+		t.Errorf("state = %v, want respMoreResults", m.state)
+	}
+	if !m.feed(append(resp, final...), caps) {
+		t.Errorf("response not complete after the final OK")
+	}
+}
+
+func TestLocalInfileExchangeStaysSynced(t *testing.T) {
+	format = nil
+	parseFormat("#q")
+	stats.queries = 0
+	stats.desyncs = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	// A multi-statement: the load, then a result set counting the rows
+	more := mysql.SERVER_MORE_RESULTS_EXISTS | mysql.SERVER_STATUS_AUTOCOMMIT
+	ok := mysqlPacket(5, []byte{0x00, 0x02, 0x00, byte(more), byte(more >> 8), 0x00, 0x00})
+	var count []byte
+	count = append(count, mysqlPacket(6, []byte{0x01})...)
+	count = append(count, mysqlPacket(7, columnDefPacket("n", mysql.MYSQL_TYPE_LONGLONG))...)
+	count = append(count, mysqlPacket(8, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})...)
+	count = append(count, mysqlPacket(9, []byte("\x012"))...)
+	count = append(count, mysqlPacket(10, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})...)
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "LOAD DATA LOCAL INFILE 'rows.csv' INTO TABLE t; SELECT COUNT(*) FROM t"...)), time.Now())
+	processResponse(rs, mysqlPacket(1, append([]byte{MYSQL_LOCAL_INFILE_PACKET}, "rows.csv"...)), time.Now())
+	if rs.response.state != respLocalInfile || rs.reqSent == nil {
+		t.Fatalf("after the LOCAL INFILE request: state = %v, want respLocalInfile and the query still in flight", rs.response.state)
+	}
+
+	// File contents that look like a COM_QUERY must not be taken for one;
+	// an empty packet ends the file
+	var file []byte
+	file = append(file, mysqlPacket(2, []byte("\x03select 1,2\n"))...)
+	file = append(file, mysqlPacket(3, []byte("3,4\n"))...)
+	file = append(file, mysqlPacket(4, nil)...)
+	processRequest(rs, file[:10], time.Now())
+	processRequest(rs, file[10:], time.Now())
+	if stats.queries != 1 {
+		t.Errorf("stats.queries = %d, want file data not counted as queries", stats.queries)
+	}
+	if rs.response.state != respExpecting {
+		t.Errorf("after the file: state = %v, want respExpecting", rs.response.state)
+	}
+
+	processResponse(rs, ok, time.Now())
+	if rs.reqSent == nil || rs.response.state != respMoreResults {
+		t.Fatalf("after the load's OK: state = %v, want respMoreResults with the query in flight", rs.response.state)
+	}
+	processResponse(rs, count, time.Now())
+	if rs.reqSent != nil || rs.respBuffer != nil {
+		t.Errorf("exchange not finished by the final result set")
+	}
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), time.Now())
+	if stats.desyncs != 0 || !rs.synced || stats.queries != 2 {
+		t.Errorf("next query: desyncs = %d, synced = %v, queries = %d, want 0, true, 2", stats.desyncs, rs.synced, stats.queries)
+	}
+}
+
+// ========== Admin Statement Tests ==========
+
+func TestIsAdminQuery(t *testing.T) {
+	for _, query := range []string{"KILL 42", "SHOW PROCESSLIST", "set global max_connections = 500", "FLUSH TABLES"} {
+		if !isAdminQuery([]byte(query)) {
+			t.Errorf("isAdminQuery(%q) = false, want true", query)
+		}
+	}
+	for _, query := range []string{"SELECT * FROM t", "INSERT INTO t VALUES (1)", "select 'KILL'"} {
+		if isAdminQuery([]byte(query)) {
+			t.Errorf("isAdminQuery(%q) = true, want false", query)
+		}
+	}
+}
+
+func TestAdminFilters(t *testing.T) {
+	defer func() {
+		adminOnly, noAdmin = false, false
+		adminCounts = make(map[string]uint64)
+	}()
+	adminCounts = make(map[string]uint64)
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	send := func(q string) {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+	}
+
+	noAdmin = true
+	stats.queries = 0
+	send("SHOW PROCESSLIST")
+	send("SELECT 1")
+	if stats.queries != 1 || len(adminCounts) != 0 {
+		t.Errorf("-no-admin: queries = %d, admin = %v, want only the SELECT", stats.queries, adminCounts)
+	}
+
+	noAdmin, adminOnly = false, true
+	stats.queries = 0
+	send("SELECT 1")
+	send("KILL 42")
+	if stats.queries != 1 || adminCounts["KILL"] != 1 {
+		t.Errorf("-admin-only: queries = %d, admin = %v, want only the KILL", stats.queries, adminCounts)
+	}
+	if !strings.Contains(rs.qText, "[admin]") {
+		t.Errorf("qText = %q, want it tagged as admin", rs.qText)
+	}
+}
+
+// ========== Procedure Call Tests ==========
+
+func TestCallProcedureName(t *testing.T) {
+	tests := map[string]string{
+		"CALL place_order(1, 2)":                "place_order",
+		"call Shop.Place_Order (1)":             "shop.place_order",
+		"/* app */ CALL `shop`.`place order`()": "shop.place order",
+		"CALL refresh_stats":                    "refresh_stats",
+		"SELECT 'CALL x()'":                     "",
+	}
+	for query, want := range tests {
+		if got := callProcedureName([]byte(query)); got != want {
+			t.Errorf("callProcedureName(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestByProcedureCounts(t *testing.T) {
+	defer func() {
+		byProcedure = false
+		procedureCounts = make(map[string]uint64)
+	}()
+	byProcedure = true
+	procedureCounts = make(map[string]uint64)
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	for _, q := range []string{"CALL shop.place_order(1)", "call `shop`.`PLACE_ORDER`(2)", "CALL refresh_stats()", "SELECT 1"} {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+	}
+	want := map[string]uint64{"shop.place_order": 2, "refresh_stats": 1}
+	if !reflect.DeepEqual(procedureCounts, want) {
+		t.Errorf("procedureCounts = %v, want %v", procedureCounts, want)
+	}
+}
+
+// ========== Buffer Boundary Tests ==========
+
+func TestCarvePacketExactFit(t *testing.T) {
+	buf := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))
+	if _, _, err := carvePacket(&buf); err != nil {
+		t.Fatalf("carvePacket: %v", err)
+	}
+	if buf != nil {
+		t.Errorf("exact fit left %#v, want nil", buf)
+	}
+
+	// One byte more leaves exactly that byte
+	buf = append(mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), 0x01)
+	carvePacket(&buf)
+	if !bytes.Equal(buf, []byte{0x01}) {
+		t.Errorf("left %#v, want the trailing byte", buf)
+	}
+}
+
+func TestExactFitPacketsNoSpuriousDesync(t *testing.T) {
+	stats.desyncs = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), time.Now())
+	if rs.reqBuffer != nil {
+		t.Errorf("reqBuffer = %#v after an exact-fit request, want nil", rs.reqBuffer)
+	}
+	processResponse(rs, ok, time.Now())
+	if rs.respBuffer != nil {
+		t.Errorf("respBuffer = %#v after an exact-fit response, want nil", rs.respBuffer)
+	}
+
+	// An empty buffer is nothing left over, whether or not it's nil
+	rs.respBuffer = []byte{}
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 2"...)), time.Now())
+	if stats.desyncs != 0 || !rs.synced {
+		t.Errorf("desyncs = %d, synced = %v, want no desync", stats.desyncs, rs.synced)
+	}
+}
+
+// ========== Status Update Tests ==========
+
+func TestStatusUpdateBeforeAnyPackets(t *testing.T) {
+	savedStats, savedStart, savedLast := stats, start, lastPacketTime
+	defer func() {
+		stats, start, lastPacketTime = savedStats, savedStart, savedLast
+		offline, countOnly = false, false
+		verbCounts = make(map[string]uint64)
+	}()
+	stats.packets.rcvd, stats.packets.rcvd_sync, stats.queries = 0, 0, 0
+	verbCounts = map[string]uint64{"SELECT": 3}
+	countOnly = true
+
+	// A capture whose only packet is its first gives zero elapsed time
+	offline = true
+	start = time.Unix(1700000000, 0)
+	lastPacketTime = start
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	handleStatusUpdate()
+
+	if strings.Contains(out.String(), "NaN") || strings.Contains(out.String(), "Inf") {
+		t.Errorf("status update printed NaN or Inf:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "0 total queries, 0.00 per second") ||
+		!strings.Contains(out.String(), "0 packets (0.00% synced)") {
+		t.Errorf("status update missing clean zeros:\n%s", out.String())
+	}
+}
+
+func TestSnapshotDir(t *testing.T) {
+	defer func() { snapshotDir, snapshotKeep = "", 0 }()
+	snapshotDir = t.TempDir()
+	snapshotKeep = 2
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	first := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		reportStatus(first.Add(time.Duration(i) * 10 * time.Second))
+	}
+
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"snapshot-20240301-120010.000.txt", "snapshot-20240301-120020.000.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("snapshots = %v, want %v", names, want)
+	}
+
+	contents, err := os.ReadFile(snapshotDir + "/" + want[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "total queries") {
+		t.Errorf("snapshot is missing the report:\n%s", contents)
+	}
+	if !strings.Contains(out.String(), "total queries") {
+		t.Errorf("report not printed as well:\n%s", out.String())
+	}
+}
+
+// ========== Epoch Marker Tests ==========
+
+func TestEpochMarkers(t *testing.T) {
+	defer func() { epochs = nil }()
+	epochs = newEpochTracker(regexp.MustCompile(`EPOCH:(\w+)`))
+	stats.queries = 0
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	send := func(q string) {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+	}
+
+	send("SELECT 'EPOCH:warmup'")
+	send("select * from t where id = 1")
+	send("select * from t where id = 2")
+	send("SELECT 'EPOCH:phase2'")
+	send("update t set n = 1 where id = 3")
+
+	if len(epochs.epochs) != 3 {
+		t.Fatalf("got %d epochs, want the opening one plus two", len(epochs.epochs))
+	}
+	warmup, phase2 := epochs.epochs[1], epochs.epochs[2]
+	if warmup.name != "warmup" || warmup.queries != 2 || warmup.verbs["SELECT"] != 2 {
+		t.Errorf("warmup epoch = %+v, want 2 SELECTs", warmup)
+	}
+	if phase2.name != "phase2" || phase2.queries != 1 || phase2.verbs["UPDATE"] != 1 {
+		t.Errorf("phase2 epoch = %+v, want 1 UPDATE", phase2)
+	}
+	if stats.queries != 3 {
+		t.Errorf("stats.queries = %d, want markers left out", stats.queries)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	epochs.report()
+	want := "Epoch warmup: 2 queries (SELECT 2)"
+	if !strings.Contains(out.String(), want) || !strings.Contains(out.String(), "Epoch phase2: 1 queries (UPDATE 1)") {
+		t.Errorf("report missing epoch sections:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "before first marker") {
+		t.Errorf("report includes the empty opening epoch:\n%s", out.String())
+	}
+}
+
+// ========== Hexdump Tests ==========
+
+func TestHexdumpUnrecognizedResponse(t *testing.T) {
+	defer func() { hexdumpUnrecognized = false }()
+	out := captureVerbose(t)
+	odd := mysqlPacket(1, []byte{0x05, 0xde, 0xad, 0xbe, 0xef})
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+
+	displayQueryResult("10.0.0.1:5000", "select ?", odd, 1000, 8, 0, false, "")
+	if strings.Contains(out.String(), "Raw:") {
+		t.Errorf("hex dump shown without -hexdump-unrecognized:\n%s", out.String())
+	}
+
+	hexdumpUnrecognized = true
+	out.Reset()
+	displayQueryResult("10.0.0.1:5000", "select ?", odd, 1000, 8, 0, false, "")
+	if !strings.Contains(out.String(), "00000000  05 00 00 01 05 de ad be  ef") {
+		t.Errorf("unrecognized response not dumped:\n%s", out.String())
+	}
+
+	out.Reset()
+	displayQueryResult("10.0.0.1:5000", "select ?", ok, 1000, 8, 0, false, "")
+	if strings.Contains(out.String(), "Raw:") {
+		t.Errorf("OK packet dumped:\n%s", out.String())
+	}
+}
+
+func TestBoundedHexdump(t *testing.T) {
+	dump := boundedHexdump(bytes.Repeat([]byte{0xab}, 40), 16)
+	if strings.Count(dump, "\n") != 2 || !strings.Contains(dump, "... 24 more bytes") {
+		t.Errorf("boundedHexdump() =\n%s", dump)
+	}
+}
+
+// ========== In-flight Tests ==========
+
+func TestInFlightGauge(t *testing.T) {
+	stats.inFlight, stats.maxInFlight = 0, 0
+	format = nil
+	parseFormat("#q")
+	a := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	b := &source{hostPort: "10.0.0.2:5000", srcIP: "10.0.0.2", synced: true}
+	c := &source{hostPort: "10.0.0.3:5000", srcIP: "10.0.0.3", synced: true}
+	query := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+
+	processRequest(a, query, time.Now())
+	processRequest(b, query, time.Now())
+	processResponse(a, ok, time.Now())
+	processRequest(c, query, time.Now())
+	processRequest(a, query, time.Now())
+	if stats.inFlight != 3 || stats.maxInFlight != 3 {
+		t.Fatalf("at peak: inFlight = %d, max = %d, want 3, 3", stats.inFlight, stats.maxInFlight)
+	}
+
+	processResponse(b, ok, time.Now())
+	processResponse(c, ok, time.Now())
+	if stats.inFlight != 1 || stats.maxInFlight != 3 {
+		t.Errorf("after two responses: inFlight = %d, max = %d, want 1, 3", stats.inFlight, stats.maxInFlight)
+	}
+
+	// Commands without a response, and streams given up on, aren't waiting
+	processRequest(a, mysqlPacket(0, []byte{mysql.COM_QUIT}), time.Now())
+	processRequest(b, query, time.Now())
+	desyncSource(b)
+	if stats.inFlight != 0 {
+		t.Errorf("after COM_QUIT and a desync: inFlight = %d, want 0", stats.inFlight)
+	}
+}
+
+// ========== Control Byte Tests ==========
+
+func TestQueryWithControlBytes(t *testing.T) {
+	defer func() { rejectControlBytes = false }()
+	format = nil
+	parseFormat("#q")
+	stats.queries, stats.controlByteQueries = 0, 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	query := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select * from t where name = x\x00\x1b[2J"...))
+
+	if got := escapeControlBytes("a\x00b\x1b\tc\n"); got != `a\x00b\x1b`+"\tc\n" {
+		t.Errorf("escapeControlBytes() = %q", got)
+	}
+
+	processRequest(rs, query, time.Now())
+	if rs.qText != `select * from t where name = x\x00\x1b[?J` {
+		t.Errorf("qText = %q, want the control bytes escaped", rs.qText)
+	}
+	if stats.queries != 1 || stats.controlByteQueries != 0 {
+		t.Errorf("without the flag: queries = %d, flagged = %d, want 1, 0", stats.queries, stats.controlByteQueries)
+	}
+
+	rejectControlBytes = true
+	processRequest(rs, query, time.Now())
+	if stats.queries != 1 || stats.controlByteQueries != 1 || rs.qText != "" {
+		t.Errorf("-reject-control-bytes: queries = %d, flagged = %d, qText = %q, want 1, 1, empty", stats.queries, stats.controlByteQueries, rs.qText)
+	}
+}
+
+// ========== Verbose Rate Tests ==========
+
+func TestVerboseRateLimit(t *testing.T) {
+	defer func() { verboseLimit = nil }()
+	out := captureVerbose(t)
+	verboseLimit = newRateLimiter(5)
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+
+	// 50 queries over one second: the initial burst of 5, then 5 more as the
+	// bucket refills
+	begin := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		ts := begin.Add(time.Duration(i) * 20 * time.Millisecond)
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...)), ts)
+		processResponse(rs, ok, ts)
+	}
+
+	shown := strings.Count(out.String(), "Query:")
+	if shown < 9 || shown > 11 {
+		t.Errorf("shown %d queries, want about 10", shown)
+	}
+	if verboseLimit.suppressed != uint64(50-shown) {
+		t.Errorf("suppressed = %d, want %d", verboseLimit.suppressed, 50-shown)
+	}
+
+	var report bytes.Buffer
+	log.SetOutput(&report)
+	defer log.SetOutput(os.Stderr)
+	handleStatusUpdate()
+	if !strings.Contains(report.String(), fmt.Sprintf("%d query displays suppressed by -verbose-rate", 50-shown)) {
+		t.Errorf("status update missing the suppressed count:\n%s", report.String())
+	}
+	if verboseLimit.suppressed != 0 {
+		t.Errorf("suppressed count not reset after reporting")
+	}
+}
+
+// ========== Wrap Width Tests ==========
+
+func TestWrapText(t *testing.T) {
+	line := fmt.Sprintf("  %sQuery:%s %sselect * from café_orders where customer_id = ? and status = ?%s",
+		COLOR_YELLOW, COLOR_DEFAULT, COLOR_WHITE, COLOR_DEFAULT)
+	wrapped := wrapText(line, 20, 9)
+
+	ansi := regexp.MustCompile("\x1b\\[[0-9;]*m")
+	lines := strings.Split(wrapped, "\n")
+	if len(lines) < 4 {
+		t.Fatalf("wrapped into %d lines, want at least 4:\n%s", len(lines), wrapped)
+	}
+	for i, l := range lines {
+		visible := ansi.ReplaceAllString(l, "")
+		if n := utf8.RuneCountInString(visible); n > 20 {
+			t.Errorf("line %d is %d columns: %q", i, n, visible)
+		}
+		if i > 0 && !strings.HasPrefix(visible, strings.Repeat(" ", 9)) {
+			t.Errorf("continuation line %d not indented: %q", i, visible)
+		}
+		if strings.Count(l, "\x1b") != len(ansi.FindAllString(l, -1)) {
+			t.Errorf("line %d splits a color sequence: %q", i, l)
+		}
+	}
+	if got := strings.ReplaceAll(wrapped, "\n"+strings.Repeat(" ", 9), ""); got != line {
+		t.Errorf("unwrapped text = %q, want %q", got, line)
+	}
+
+	if got := wrapText(line, 0, 9); got != line {
+		t.Errorf("width 0 changed the text: %q", got)
+	}
+}
+
+// ========== MariaDB Progress Tests ==========
+
+func TestMariaDBProgressReport(t *testing.T) {
+	out := captureVerbose(t)
+	info := "copy to tmp table"
+	progress := append([]byte{0xff, 0xff, 0xff, 1, 2, 0x50, 0xc3, 0x00, byte(len(info))}, info...) // 50.000%
+	ok := []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+
+	p, isProgress := parseProgressReport(progress)
+	if !isProgress || p.stage != 1 || p.maxStage != 2 || p.progress != 50000 || p.info != info {
+		t.Fatalf("parseProgressReport() = %+v, %v", p, isProgress)
+	}
+	if got := parseResponse(progress, false); strings.Contains(got, "ERROR") || !strings.Contains(got, "stage 1/2, 50.0%") {
+		t.Errorf("parseResponse(progress) = %q, want a progress update", got)
+	}
+
+	// The report doesn't end the response; the OK after it does
+	resp := append(mysqlPacket(1, progress), mysqlPacket(2, ok)...)
+	var m responseMachine
+	if m.feed(resp[:len(progress)+4], 0) {
+		t.Errorf("response complete after only a progress report")
+	}
+	if !m.feed(resp, 0) {
+		t.Errorf("response not complete after the OK")
+	}
+
+	displayQueryResult("10.0.0.1:5000", "alter table t add column c int", resp, 1000, 32, 0, false, "")
+	if !strings.Contains(out.String(), "Result:\\x1b[39m \\x1b[32mOK") || !strings.Contains(out.String(), "(1 report(s))") {
+		t.Errorf("display should show the OK and the progress:\n%s", out.String())
+	}
+}
+
+// ========== Read/Write Ratio Tests ==========
+
+func TestReadWriteRatio(t *testing.T) {
+	savedStats := stats
+	defer func() {
+		stats = savedStats
+		rwLast.reads, rwLast.writes, rwLast.ratio = 0, 0, ""
+	}()
+	stats.reads, stats.writes, stats.ddl = 0, 0, 0
+	rwLast.reads, rwLast.writes, rwLast.ratio = 0, 0, ""
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	send := func(queries ...string) {
+		for _, q := range queries {
+			processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+		}
+	}
+
+	send("SELECT 1", "select * from t", "SHOW TABLES", "INSERT INTO t VALUES (1)", "ALTER TABLE t ADD c INT", "BEGIN")
+	if stats.reads != 3 || stats.writes != 1 || stats.ddl != 1 {
+		t.Fatalf("reads, writes, ddl = %d, %d, %d, want 3, 1, 1", stats.reads, stats.writes, stats.ddl)
+	}
+	if got := readWriteRatio(stats.reads, stats.writes); got != "3.00" {
+		t.Errorf("readWriteRatio() = %s, want 3.00", got)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	handleStatusUpdate()
+	if !strings.Contains(out.String(), "3 reads, 1 writes, 1 DDL: 3.00 reads per write (3.00 this interval)") {
+		t.Errorf("first status update:\n%s", out.String())
+	}
+
+	// The next interval is write-heavy
+	send("UPDATE t SET c = 1", "DELETE FROM t WHERE c = 2", "SELECT 1")
+	out.Reset()
+	handleStatusUpdate()
+	if !strings.Contains(out.String(), "4 reads, 3 writes, 1 DDL: 1.33 reads per write (0.50 this interval, was 3.00)") {
+		t.Errorf("second status update:\n%s", out.String())
+	}
+}
+
+// ========== Emit New Tests ==========
+
+func TestEmitNewQueries(t *testing.T) {
+	var out bytes.Buffer
+	defer func() {
+		emitNew = false
+		seenQueries = make(map[string]bool)
+		emitOut = os.Stdout
+	}()
+	emitNew = true
+	seenQueries = make(map[string]bool)
+	emitOut = &out
+	format = nil
+	parseFormat("#s #q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	for _, q := range []string{
+		"select * from t where id = 1",
+		"SELECT 1",
+		"select * from t where id = 2",
+		"select *\n  from t where id = 3",
+		"SELECT 1",
+	} {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+	}
+
+	if want := "select * from t where id = ?\nSELECT ?\n"; out.String() != want {
+		t.Errorf("emitted %q, want %q", out.String(), want)
+	}
+}
+
+// ========== Wide Result Set Tests ==========
+
+func TestWideResultSet(t *testing.T) {
+	const columns = 300
+	long := strings.Repeat("w", 300) // its length needs a 3-byte length-encoded int too
+
+	var packets [][]byte
+	packets = append(packets, mysql.PutLengthEncodedInt(columns))
+	var row []byte
+	for i := 1; i <= columns; i++ {
+		packets = append(packets, columnDefPacket(fmt.Sprintf("c%d", i), mysql.MYSQL_TYPE_VAR_STRING))
+		switch i {
+		case 2:
+			row = append(row, 0xfb) // NULL
+		case 150:
+			row = append(row, mysql.PutLengthEncodedString([]byte(long))...)
+		default:
+			row = append(row, mysql.PutLengthEncodedString([]byte(fmt.Sprintf("v%d", i)))...)
+		}
+	}
+	packets = append(packets, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})
+	packets = append(packets, row)
+	packets = append(packets, []byte{0xfe, 0x00, 0x00, 0x02, 0x00})
+
+	if packets[0][0] != 0xfc {
+		t.Fatalf("column count packet = %#v, want a 3-byte length-encoded int", packets[0])
+	}
+
+	values := parseRowData(row, columns)
+	if len(values) != columns || values[1] != "NULL" || values[149] != long || values[299] != "v300" {
+		t.Errorf("parseRowData() gave %d values, want %d with NULL, the long value and v300 in place", len(values), columns)
+	}
+
+	result := parseResultSetFull(packets, mysql.CLIENT_PROTOCOL_41, true, "")
+	for _, want := range []string{"ResultSet: 300 column(s)", "c2\x1b[39m=\x1b[37mNULL", "c300\x1b[39m=\x1b[37mv300", "Total: 1 row(s)"} {
+		if !strings.Contains(result, want) {
+			t.Errorf("parseResultSetFull() missing %q", want)
+		}
+	}
+
+	var buf []byte
+	for i, pkt := range packets {
+		buf = append(buf, mysqlPacket(byte(i+1), pkt)...)
+	}
+	var whole, partial responseMachine
+	if !whole.feed(buf, mysql.CLIENT_PROTOCOL_41) {
+		t.Errorf("300-column response not complete")
+	}
+	if partial.feed(buf[:len(buf)-9], mysql.CLIENT_PROTOCOL_41) {
+		t.Errorf("300-column response complete before its final EOF")
+	}
+}
+
+// ========== Binlog Dump Tests ==========
+
+func TestParseBinlogDump(t *testing.T) {
+	data := []byte{0x04, 0x01, 0x00, 0x00} // position 260
+	data = append(data, 0x00, 0x00)        // flags
+	data = append(data, 0x2a, 0x00, 0x00, 0x00)
+	data = append(data, "mysql-bin.000042"...)
+
+	d, err := parseBinlogDump(data)
+	if err != nil {
+		t.Fatalf("parseBinlogDump() error = %v", err)
+	}
+	if d.file != "mysql-bin.000042" || d.position != 260 || d.serverID != 42 {
+		t.Errorf("parseBinlogDump() = %+v, want mysql-bin.000042:260 from server-id 42", d)
+	}
+
+	if _, err := parseBinlogDump(data[:8]); err == nil {
+		t.Errorf("parseBinlogDump() accepted a truncated packet")
+	}
+}
+
+func TestParseBinlogDumpGTID(t *testing.T) {
+	file := "binlog.000003"
+	data := []byte{BINLOG_THROUGH_GTID, 0x00, 0x07, 0x00, 0x00, 0x00}
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(file)))
+	data = append(data, file...)
+	data = binary.LittleEndian.AppendUint64(data, 4)
+
+	set, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := set.Encode()
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(encoded)))
+	data = append(data, encoded...)
+
+	d, err := parseBinlogDumpGTID(data)
+	if err != nil {
+		t.Fatalf("parseBinlogDumpGTID() error = %v", err)
+	}
+	if d.file != file || d.position != 4 || d.serverID != 7 || d.gtidSet != "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5" {
+		t.Errorf("parseBinlogDumpGTID() = %+v", d)
+	}
+}
+
+func TestBinlogDumpMarksReplica(t *testing.T) {
+	savedReplicas := replicas
+	replicas = make(map[string]binlogDump)
+	defer func() { replicas = savedReplicas }()
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	rs := &source{hostPort: "10.0.0.9:5000", srcIP: "10.0.0.9", synced: true}
+	dump := append([]byte{0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}, "mysql-bin.000001"...)
+	processCommand(rs, CommandType(mysql.COM_BINLOG_DUMP), dump, time.Now())
+
+	if !rs.replica || rs.reqSent != nil {
+		t.Errorf("binlog dump: replica = %v, reqSent = %v; want a replica with nothing timed", rs.replica, rs.reqSent)
+	}
+	if !strings.Contains(out.String(), "Replica 10.0.0.9:5000 requested the binlog, server-id 2 from mysql-bin.000001:4") {
+		t.Errorf("binlog dump not logged, got %q", out.String())
+	}
+
+	// Binlog events from the server are dropped rather than buffered
+	processResponse(rs, []byte{0x10, 0x00, 0x00, 0x01, 0x00, 0x01, 0x02}, time.Now())
+	if rs.respBuffer != nil {
+		t.Errorf("binlog event buffered as a response")
+	}
+}
+
+// ========== Time-Wasting Function Tests ==========
+
+func TestTimeWastingCall(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT SLEEP(?)", "SLEEP"},
+		{"SELECT BENCHMARK(?, ?)", "BENCHMARK"},
+		{"select * from users where id = 1 and sleep (5)", "SLEEP"},
+		{"SELECT id, name FROM users WHERE id = ?", ""},
+		{"SELECT sleep FROM schedules", ""},
+		{"SELECT 'SLEEP(5)'", ""},
+	}
+	for _, tt := range tests {
+		if got := timeWastingCall([]byte(tt.query)); got != tt.want {
+			t.Errorf("timeWastingCall(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestTimeWastingWarning(t *testing.T) {
+	savedStats := stats
+	defer func() { stats = savedStats }()
+	stats.timeWastingQueries = 0
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	for _, q := range []string{"SELECT SLEEP(5)", "SELECT 1"} {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+	}
+
+	if stats.timeWastingQueries != 1 {
+		t.Errorf("stats.timeWastingQueries = %d, want 1", stats.timeWastingQueries)
+	}
+	if !strings.Contains(out.String(), "SLEEP() called from 10.0.0.1:5000: SELECT SLEEP(?)") {
+		t.Errorf("missing warning:\n%s", out.String())
+	}
+}
+
+// ========== Verbose Dedup Tests ==========
+
+func TestVerboseDedup(t *testing.T) {
+	defer func() { verboseDedup = nil }()
+	out := captureVerbose(t)
+	verboseDedup = newVerboseDeduper(time.Second)
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+
+	begin := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	query := func(q string, ts time.Time) {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), ts)
+		processResponse(rs, ok, ts)
+	}
+
+	// An N+1 loop: 47 lookups 10ms apart, then something else
+	for i := 0; i < 47; i++ {
+		query(fmt.Sprintf("select * from users where id = %d", i), begin.Add(time.Duration(i)*10*time.Millisecond))
+	}
+	query("select count(*) from orders", begin.Add(time.Second))
+
+	if shown := strings.Count(out.String(), "Query:"); shown != 2 {
+		t.Errorf("shown %d queries in full, want 2", shown)
+	}
+	// The handler escapes the color codes
+	if n := strings.Count(out.String(), "[33mx47"); n != 1 {
+		t.Errorf("got %d x47 lines, want 1:\n%s", n, out.String())
+	}
+	if !strings.Contains(out.String(), `x47\x1b[39m \x1b[37mselect * from users where id = ?`) {
+		t.Errorf("x47 line doesn't name the query:\n%s", out.String())
+	}
+
+	// Past the window the same query is shown in full again, and a query
+	// that ran once gets no count line
+	query("select count(*) from orders", begin.Add(3*time.Second))
+	verboseDedup.flush(time.Time{})
+	if shown := strings.Count(out.String(), "Query:"); shown != 3 {
+		t.Errorf("shown %d queries in full, want 3", shown)
+	}
+	if n := strings.Count(out.String(), "[33mx"); n != 1 {
+		t.Errorf("count line for queries that didn't repeat:\n%s", out.String())
+	}
+}
+
+// ========== Affected Rows Tests ==========
+
+// okPacket builds an OK packet payload reporting the given affected rows
+func okPacket(rows uint64) []byte {
+	return append(append([]byte{MYSQL_OK_PACKET}, mysql.PutLengthEncodedInt(rows)...), 0x00, 0x02, 0x00, 0x00, 0x00)
+}
+
+func TestResponseAffectedRows(t *testing.T) {
+	single := mysqlPacket(1, okPacket(300))
+	if got := responseAffectedRows(single); got != 300 {
+		t.Errorf("responseAffectedRows(single OK) = %d, want 300", got)
+	}
+
+	batch := append(mysqlPacket(1, okPacket(2)), mysqlPacket(2, okPacket(5))...)
+	if got := responseAffectedRows(batch); got != 7 {
+		t.Errorf("responseAffectedRows(two OKs) = %d, want 7", got)
+	}
+
+	errPkt := mysqlPacket(1, []byte{0xff, 0x26, 0x04, '#', 'H', 'Y', '0', '0', '0', 'x'})
+	if got := responseAffectedRows(errPkt); got != 0 {
+		t.Errorf("responseAffectedRows(ERR) = %d, want 0", got)
+	}
+}
+
+func TestAffectedRowsByQuery(t *testing.T) {
+	savedByAffected, savedAffected := byAffectedRows, affectedRows
+	defer func() { byAffectedRows, affectedRows = savedByAffected, savedAffected }()
+	byAffectedRows = true
+	affectedRows = make(map[string]uint64)
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	query := func(q string, rows uint64) {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+		processResponse(rs, mysqlPacket(1, okPacket(rows)), time.Now())
+	}
+	query("UPDATE orders SET status = 'shipped' WHERE batch = 1", 120)
+	query("UPDATE orders SET status = 'shipped' WHERE batch = 2", 80)
+	query("DELETE FROM sessions WHERE expires < 1700000000", 15)
+	query("SET autocommit = 0", 0)
+	query("SELECT 1", 0)
+
+	want := map[string]uint64{
+		"UPDATE orders SET status = ? WHERE batch = ?": 200,
+		"DELETE FROM sessions WHERE expires < ?":       15,
+	}
+	if !reflect.DeepEqual(affectedRows, want) {
+		t.Errorf("affectedRows = %v, want %v", affectedRows, want)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	handleStatusUpdate()
+	report := out.String()
+	update, del := strings.Index(report, "200  UPDATE orders"), strings.Index(report, "15  DELETE FROM sessions")
+	if !strings.Contains(report, "Rows changed by write:") || update < 0 || del < update {
+		t.Errorf("status update missing the affected rows, heaviest first:\n%s", report)
+	}
+}
+
+// ========== Session Charset Tests ==========
+
+func TestParseCharsetSet(t *testing.T) {
+	tests := []struct {
+		query string
+		want  sessionCharset
+		ok    bool
+	}{
+		{"SET NAMES utf8mb4", sessionCharset{"utf8mb4", "utf8mb4"}, true},
+		{"set names 'latin1' collate 'latin1_swedish_ci'", sessionCharset{"latin1", "latin1"}, true},
+		{"SET CHARACTER SET sjis", sessionCharset{"sjis", "sjis"}, true},
+		{"SET character_set_client = gbk", sessionCharset{"gbk", "cp1251"}, true},
+		{"SET @@session.character_set_results = NULL, autocommit = 1", sessionCharset{"cp1251", ""}, true},
+		{"SET SESSION character_set_results = 'latin2'", sessionCharset{"cp1251", "latin2"}, true},
+		{"SET autocommit = 0", sessionCharset{"cp1251", "cp1251"}, false},
+		{"SELECT 'SET NAMES latin1'", sessionCharset{"cp1251", "cp1251"}, false},
+	}
+	current := sessionCharset{"cp1251", "cp1251"}
+	for _, tt := range tests {
+		got, ok := parseCharsetSet([]byte(tt.query), sqlMode{}, current)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseCharsetSet(%q) = %+v, %v; want %+v, %v", tt.query, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSessionCharsetRendersValues(t *testing.T) {
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "SET NAMES latin1"...)), time.Now())
+	processResponse(rs, ok, time.Now())
+	if rs.charset != (sessionCharset{"latin1", "latin1"}) {
+		t.Fatalf("charset after SET NAMES latin1 = %+v", rs.charset)
+	}
+
+	// A text column and a binary one holding the same latin1 bytes
+	column := func(name string, charsetID uint16) []byte {
+		def := []byte{}
+		for _, s := range []string{"def", "test", "t", "t", name, name} {
+			def = append(def, mysql.PutLengthEncodedString([]byte(s))...)
+		}
+		def = append(def, 0x0c)
+		def = binary.LittleEndian.AppendUint16(def, charsetID)
+		def = append(def, 0xff, 0x00, 0x00, 0x00, mysql.MYSQL_TYPE_VAR_STRING, 0x00, 0x00, 0x00, 0x00, 0x00)
+		return def
+	}
+	row := append(mysql.PutLengthEncodedString([]byte("caf\xe9")), mysql.PutLengthEncodedString([]byte("caf\xe9"))...)
+	packets := [][]byte{{0x02}, column("name", 8), column("raw", BINARY_CHARSET_ID), {0xfe, 0x00, 0x00, 0x02, 0x00}, row, {0xfe, 0x00, 0x00, 0x02, 0x00}}
+
+	result := parseResultSetFull(packets, mysql.CLIENT_PROTOCOL_41, true, rs.charset.results)
+	if !strings.Contains(result, "name\x1b[39m=\x1b[37mcafé") {
+		t.Errorf("latin1 value not decoded:\n%q", result)
+	}
+	if !strings.Contains(result, "raw\x1b[39m=\x1b[37mcaf\xe9") {
+		t.Errorf("binary value decoded:\n%q", result)
+	}
+
+	// Without SET NAMES the bytes are shown as they came
+	if result := parseResultSetFull(packets, mysql.CLIENT_PROTOCOL_41, true, ""); strings.Contains(result, "café") {
+		t.Errorf("value decoded without a session charset:\n%q", result)
+	}
+
+	// COM_RESET_CONNECTION puts the session back to the default
+	processRequest(rs, mysqlPacket(0, []byte{mysql.COM_RESET_CONNECTION}), time.Now())
+	if rs.charset != (sessionCharset{}) {
+		t.Errorf("charset after COM_RESET_CONNECTION = %+v, want the default", rs.charset)
+	}
+}
+
+// ========== Load Shedding Tests ==========
+
+func TestLoadShedding(t *testing.T) {
+	savedStats, savedVerbs, savedChmap := stats, verbCounts, chmap
+	defer func() { stats, verbCounts, chmap, shedder = savedStats, savedVerbs, savedChmap, nil }()
+	verbCounts = make(map[string]uint64)
+	chmap = make(map[string]*source)
+	shedder = newLoadShedder(100)
+	format = nil
+	parseFormat("#q")
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	chmap["10.0.0.1:5000"] = rs
+	query := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select * from t where id = 1"...))
+	begin := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// A backlog building up, but not yet to the threshold
+	checkBacklog(99, begin)
+	if shedder.degraded {
+		t.Fatalf("degraded below the threshold")
+	}
+
+	// Over it: requests are only counted by verb, responses ignored
+	checkBacklog(150, begin.Add(time.Second))
+	if !shedder.degraded {
+		t.Fatalf("not degraded with a backlog of 150")
+	}
+	processPacket(rs, true, query, begin.Add(time.Second))
+	processPacket(rs, false, mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}), begin.Add(time.Second))
+	if verbCounts["SELECT"] != 1 || rs.reqSent != nil || rs.respBuffer != nil {
+		t.Errorf("degraded: verbCounts = %v, reqSent = %v, respBuffer = %v; want the query counted and nothing else", verbCounts, rs.reqSent, rs.respBuffer)
+	}
+
+	// Still above the low water mark
+	checkBacklog(60, begin.Add(2*time.Second))
+	if !shedder.degraded {
+		t.Fatalf("recovered before the backlog drained to half the threshold")
+	}
+
+	// Drained: full processing again, with every stream resyncing
+	checkBacklog(50, begin.Add(4*time.Second))
+	if shedder.degraded {
+		t.Fatalf("still degraded once the backlog drained")
+	}
+	if rs.synced {
+		t.Errorf("stream still synced after coming out of count-only processing")
+	}
+	if got := shedder.degradedFor(begin.Add(time.Hour)); got != 3*time.Second {
+		t.Errorf("degradedFor() = %s, want 3s", got)
+	}
+	if !strings.Contains(out.String(), "Backlog of 150 packets") || !strings.Contains(out.String(), "Caught up after 3s") {
+		t.Errorf("mode changes not logged:\n%s", out.String())
+	}
+
+	processPacket(rs, true, query, begin.Add(5*time.Second))
+	if verbCounts["SELECT"] != 1 || !rs.synced || rs.reqSent == nil {
+		t.Errorf("query after recovering not processed in full")
+	}
+
+	out.Reset()
+	handleStatusUpdate()
+	if !strings.Contains(out.String(), "Counted queries only for 3s to keep up with the capture, 1 time(s)") {
+		t.Errorf("status update missing the time degraded:\n%s", out.String())
+	}
+}
+
+// ========== WHERE Columns Tests ==========
+
+func TestWhereColumns(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT * FROM orders WHERE user_id = ? AND status = ? ORDER BY created_at", []string{"status", "user_id"}},
+		{"select * from orders o where o.`status` in (1, 2) and o.user_id=42 limit 10", []string{"status", "user_id"}},
+		{"SELECT id FROM t WHERE (a > 5 OR b IS NOT NULL) AND c BETWEEN 1 AND 9 AND d NOT LIKE 'x%'", []string{"a", "b", "c", "d"}},
+		{"SELECT * FROM a, b WHERE a.id = b.a_id AND b.kind = 'x'", []string{"kind"}},
+		{"SELECT * FROM t WHERE id IN (SELECT t_id FROM u WHERE flag = 1) AND deleted = 0", []string{"deleted"}},
+		{"SELECT * FROM t WHERE DATE(created_at) = ? GROUP BY x HAVING y > 1", []string{}},
+		{"UPDATE t SET x = 1 WHERE id = -3", []string{"id"}},
+		{"SELECT * FROM t", nil},
+	}
+	for _, tt := range tests {
+		got := whereColumns([]byte(tt.query))
+		if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("whereColumns(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestByWhereColumns(t *testing.T) {
+	savedBy, savedCounts := byWhereColumns, whereColumnCounts
+	defer func() { byWhereColumns, whereColumnCounts = savedBy, savedCounts }()
+	byWhereColumns = true
+	whereColumnCounts = make(map[string]uint64)
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	for _, q := range []string{
+		"SELECT * FROM orders WHERE user_id = 1 AND status = 'open'",
+		"SELECT id, total FROM orders WHERE status = 'paid' AND user_id = 7 ORDER BY id",
+		"SELECT * FROM users WHERE email = 'a@example.com'",
+		"SELECT COUNT(*) FROM orders",
+	} {
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), time.Now())
+	}
+
+	want := map[string]uint64{"{status, user_id}": 2, "{email}": 1}
+	if !reflect.DeepEqual(whereColumnCounts, want) {
+		t.Errorf("whereColumnCounts = %v, want %v", whereColumnCounts, want)
+	}
+}
+
+// ========== Connection Close Tests ==========
+
+// withFlags sets TCP flags on a decoded packet from tcpSegment
+func withFlags(packet gopacket.Packet, fin, rst bool) gopacket.Packet {
+	tcp := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	tcp.FIN, tcp.RST = fin, rst
+	return packet
+}
+
+func TestCloseMidResponse(t *testing.T) {
+	savedStats := stats
+	defer func() { stats = savedStats; serverPorts = nil }()
+	serverPorts = []portRange{{3306, 3306}}
+	chmap = make(map[string]*source)
+	stats.closedIncomplete, stats.closedUnanswered, stats.inFlight = 0, 0, 0
+	format = nil
+	parseFormat("#q")
+
+	// A result set cut off after its column definitions, then the client
+	// hangs up
+	query := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select n from t"...))
+	handlePacket(tcpSegment(t, 51000, true, false, 1000, query))
+	var partial []byte
+	partial = append(partial, mysqlPacket(1, []byte{0x01})...)
+	partial = append(partial, mysqlPacket(2, columnDefPacket("n", mysql.MYSQL_TYPE_LONGLONG))...)
+	handlePacket(tcpSegment(t, 51000, false, false, 5000, partial))
+	handlePacket(withFlags(tcpSegment(t, 51000, true, false, 1000+uint32(len(query)), nil), true, false))
+
+	if stats.closedIncomplete != 1 || stats.closedUnanswered != 0 {
+		t.Errorf("closedIncomplete = %d, closedUnanswered = %d; want 1, 0", stats.closedIncomplete, stats.closedUnanswered)
+	}
+	rs := chmap["10.0.0.1:51000"]
+	if rs.inFlight || rs.reqSent != nil || rs.respBuffer != nil || stats.inFlight != 0 {
+		t.Errorf("request still in flight after the close")
+	}
+
+	// The server's FIN in reply doesn't count it again
+	handlePacket(withFlags(tcpSegment(t, 51000, false, false, 5000+uint32(len(partial)), nil), true, false))
+	if stats.closedIncomplete != 1 {
+		t.Errorf("closedIncomplete = %d after the second FIN, want 1", stats.closedIncomplete)
+	}
+
+	// A reset while a query runs with no response yet, on another connection
+	handlePacket(tcpSegment(t, 52000, true, false, 1000, query))
+	handlePacket(withFlags(tcpSegment(t, 52000, true, false, 1000+uint32(len(query)), nil), false, true))
+	if stats.closedUnanswered != 1 {
+		t.Errorf("closedUnanswered = %d, want 1", stats.closedUnanswered)
+	}
+
+	// A FIN on a connection we never saw doesn't create a stream
+	handlePacket(withFlags(tcpSegment(t, 53000, true, false, 1000, nil), true, false))
+	if _, ok := chmap["10.0.0.1:53000"]; ok {
+		t.Errorf("bare FIN created a stream")
+	}
+}
+
+// ========== IPv6 Tests ==========
+
+// tcpSegment6 builds a decoded client-to-server IPv6/TCP packet from
+// [2001:db8::1]:clientPort to [2001:db8::2]:3306
+func tcpSegment6(t *testing.T, clientPort uint16, seq uint32, payload []byte) gopacket.Packet {
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(clientPort), DstPort: 3306, Seq: seq, PSH: true, ACK: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatalf("SerializeLayers: %v", err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.Default)
+}
+
+func TestHandlePacketIPv6(t *testing.T) {
+	savedStats, savedAnon := stats, anonymizeIPs
+	defer func() { stats, anonymizeIPs = savedStats, savedAnon; serverPorts = nil }()
+	serverPorts = []portRange{{3306, 3306}}
+	chmap = make(map[string]*source)
+	stats.queries = 0
+	format = nil
+	parseFormat("#i #q")
+
+	query := mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))
+	handlePacket(tcpSegment6(t, 51000, 1000, query))
+
+	rs := chmap["[2001:db8::1]:51000"]
+	if rs == nil {
+		t.Fatalf("no stream keyed [2001:db8::1]:51000, have %v", chmap)
+	}
+	if rs.srcIP != "2001:db8::1" || rs.hostPort != "[2001:db8::1]:51000" {
+		t.Errorf("srcIP = %q, hostPort = %q", rs.srcIP, rs.hostPort)
+	}
+	if stats.queries != 1 || rs.qText != "2001:db8::1 select ?" {
+		t.Errorf("queries = %d, qText = %q; want the query counted with #i as the bare address", stats.queries, rs.qText)
+	}
+
+	// Anonymized, the pseudonym is still an IPv6 address with the port kept
+	anonymizeIPs = true
+	handlePacket(tcpSegment6(t, 51001, 1000, query))
+	rs = chmap["[2001:db8::1]:51001"]
+	if rs == nil {
+		t.Fatalf("no stream keyed [2001:db8::1]:51001")
+	}
+	if host, port, err := net.SplitHostPort(rs.hostPort); err != nil || port != "51001" || net.ParseIP(host).To4() != nil || host == "2001:db8::1" {
+		t.Errorf("anonymized hostPort = %q", rs.hostPort)
+	}
+}
+
+// ========== Loki Tests ==========
+
+func TestLokiPush(t *testing.T) {
+	var mu sync.Mutex
+	var pushes []map[string][]lokiStream
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/loki/api/v1/push" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("push to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		// The first attempt fails, to be retried
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var push map[string][]lokiStream
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Errorf("decoding push: %v", err)
+		}
+		pushes = append(pushes, push)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	defer func() { loki = nil }()
+	loki = newLokiPusher(server.URL+"/", "sniffer-1")
+	loki.backoff = time.Millisecond
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	ok := mysqlPacket(1, []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+
+	begin := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, q := range []string{"SELECT * FROM users WHERE id = 1", "SELECT * FROM users WHERE id = 2", "UPDATE users SET seen = 1 WHERE id = 3"} {
+		ts := begin.Add(time.Duration(i) * time.Second)
+		processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, q...)), ts)
+		processResponse(rs, ok, ts.Add(1500*time.Microsecond))
+	}
+	go loki.run()
+	loki.stop()
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(pushes) != 1 || len(pushes[0]["streams"]) != 2 {
+		t.Fatalf("got %d pushes, want one with a SELECT and an UPDATE stream: %+v", len(pushes), pushes)
+	}
+	selects := pushes[0]["streams"][0]
+	want := map[string]string{"job": "mysql-sniffer", "host": "sniffer-1", "verb": "SELECT", "source": "10.0.0.1"}
+	if !reflect.DeepEqual(selects.Stream, want) {
+		t.Errorf("stream labels = %v, want %v", selects.Stream, want)
+	}
+	if len(selects.Values) != 2 {
+		t.Fatalf("SELECT stream has %d lines, want 2", len(selects.Values))
+	}
+	if selects.Values[1][0] != fmt.Sprint(begin.Add(time.Second).UnixNano()) ||
+		selects.Values[1][1] != `latency_ms=1.500 query="SELECT * FROM users WHERE id = ?"` {
+		t.Errorf("SELECT line = %v", selects.Values[1])
+	}
+	if got := pushes[0]["streams"][1].Stream["verb"]; got != "UPDATE" {
+		t.Errorf("second stream verb = %q, want UPDATE", got)
+	}
+	if loki.pushed.Load() != 3 || loki.failed.Load() != 0 {
+		t.Errorf("pushed = %d, failed = %d; want 3, 0 after the retry", loki.pushed.Load(), loki.failed.Load())
+	}
+}
+
+// ========== Multi-Packet Payload Tests ==========
+
+func TestCarvePacketJoinsChunks(t *testing.T) {
+	// A COM_QUERY of 16MB + 10 bytes: a full chunk, then the rest
+	payload := append([]byte{mysql.COM_QUERY}, "insert into blobs values ('"...)
+	payload = append(payload, bytes.Repeat([]byte("x"), mysql.MaxPayloadLen+10-len(payload)-2)...)
+	payload = append(payload, "')"...)
+
+	buf := mysqlPacket(0, payload[:mysql.MaxPayloadLen])
+	buf = append(buf, mysqlPacket(1, payload[mysql.MaxPayloadLen:])...)
+	buf = append(buf, mysqlPacket(0, append([]byte{mysql.COM_QUERY}, "select 1"...))...)
+
+	// Nothing comes out until the last chunk is in
+	partial := buf[:mysql.MaxPayloadLen+8]
+	if _, _, err := carvePacket(&partial); err == nil {
+		t.Errorf("carvePacket() returned a payload missing its last chunk")
+	}
+
+	pType, data, err := carvePacket(&buf)
+	if err != nil {
+		t.Fatalf("carvePacket() error = %v", err)
+	}
+	if pType != CommandType(mysql.COM_QUERY) || !bytes.Equal(data, payload[1:]) {
+		t.Errorf("carvePacket() = %s with %d bytes, want COM_QUERY with %d", pType.String(), len(data), len(payload)-1)
+	}
+
+	// The packet after it is left for next time
+	if _, data, err := carvePacket(&buf); err != nil || string(data) != "select 1" || buf != nil {
+		t.Errorf("next packet = %q, %v, with %d bytes left", data, err, len(buf))
+	}
+
+	// A payload exactly one chunk long ends with an empty chunk
+	exact := append(mysqlPacket(0, payload[:mysql.MaxPayloadLen]), 0x00, 0x00, 0x00, 0x01)
+	if _, data, err := carvePacket(&exact); err != nil || len(data) != mysql.MaxPayloadLen-1 || exact != nil {
+		t.Errorf("exact chunk: %d bytes, %v, with %d bytes left", len(data), err, len(exact))
+	}
+}
+
+func TestCarvePacketChunkSequence(t *testing.T) {
+	payload := append([]byte{mysql.COM_QUERY}, bytes.Repeat([]byte("x"), mysql.MaxPayloadLen+9)...)
+
+	// Sequence IDs wrap around: 255 is followed by 0
+	wrapped := append(mysqlPacket(255, payload[:mysql.MaxPayloadLen]), mysqlPacket(0, payload[mysql.MaxPayloadLen:])...)
+	if _, data, err := carvePacket(&wrapped); err != nil || len(data) != len(payload)-1 {
+		t.Errorf("wrapped sequence: %d bytes, %v", len(data), err)
+	}
+
+	// A chunk that doesn't follow on is some other packet, not a continuation
+	bad := append(mysqlPacket(0, payload[:mysql.MaxPayloadLen]), mysqlPacket(5, payload[mysql.MaxPayloadLen:])...)
+	if _, _, err := carvePacket(&bad); !errors.Is(err, errChunkSequence) {
+		t.Errorf("carvePacket() error = %v, want errChunkSequence", err)
+	}
+
+	savedStats := stats
+	defer func() { stats = savedStats }()
+	stats.desyncs = 0
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	processRequest(rs, append(mysqlPacket(0, payload[:mysql.MaxPayloadLen]), mysqlPacket(5, payload[mysql.MaxPayloadLen:])...), time.Now())
+	if stats.desyncs != 1 || rs.synced || rs.reqBuffer != nil {
+		t.Errorf("desyncs = %d, synced = %v, %d bytes buffered after a chunk out of sequence", stats.desyncs, rs.synced, len(rs.reqBuffer))
+	}
+}
+
+// ========== Schema Command Tests ==========
+
+func TestDropDBCommand(t *testing.T) {
+	savedStats := stats
+	defer func() { stats = savedStats }()
+	stats.createDatabases, stats.dropDatabases = 0, 0
+	format = nil
+	parseFormat("#q")
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	buf := mysqlPacket(0, append([]byte{mysql.COM_DROP_DB}, "orders_archive"...))
+	pType, pData, err := carvePacket(&buf)
+	if err != nil || pType != CommandType(mysql.COM_DROP_DB) || string(pData) != "orders_archive" {
+		t.Fatalf("carvePacket() = %s, %q, %v", pType.String(), pData, err)
+	}
+	processCommand(rs, pType, pData, time.Now())
+
+	if stats.dropDatabases != 1 || stats.createDatabases != 0 {
+		t.Errorf("dropDatabases = %d, createDatabases = %d; want 1, 0", stats.dropDatabases, stats.createDatabases)
+	}
+	if !strings.Contains(out.String(), "COM_DROP_DB from 10.0.0.1:5000: database orders_archive") {
+		t.Errorf("missing warning:\n%s", out.String())
+	}
+	if rs.reqSent == nil {
+		t.Errorf("COM_DROP_DB not waiting for its response")
+	}
+}
+
+// ========== Prepared Statement Tests ==========
+
+// prepareOKPacket builds a PREPARE_OK payload for the given statement ID,
+// column count and parameter count
+func prepareOKPacket(id uint32, columns, params uint16) []byte {
+	pkt := []byte{MYSQL_OK_PACKET}
+	pkt = binary.LittleEndian.AppendUint32(pkt, id)
+	pkt = binary.LittleEndian.AppendUint16(pkt, columns)
+	pkt = binary.LittleEndian.AppendUint16(pkt, params)
+	return append(pkt, 0x00, 0x00, 0x00)
+}
+
+func TestPrepareDefinitions(t *testing.T) {
+	tests := []struct {
+		name         string
+		pkt          []byte
+		capabilities uint32
+		want         int
+	}{
+		{"params and columns", prepareOKPacket(1, 2, 1), 0, 5},
+		{"params only", prepareOKPacket(1, 0, 2), 0, 3},
+		{"no definitions", prepareOKPacket(1, 0, 0), 0, 0},
+		{"deprecate EOF", prepareOKPacket(1, 2, 1), mysql.CLIENT_DEPRECATE_EOF, 3},
+		{"metadata skipped", append(prepareOKPacket(1, 2, 1), RESULTSET_METADATA_NONE), mysql.CLIENT_OPTIONAL_RESULTSET_METADATA, 0},
+		{"truncated", []byte{MYSQL_OK_PACKET, 1, 0, 0, 0}, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := prepareDefinitions(tt.pkt, tt.capabilities); got != tt.want {
+			t.Errorf("%s: prepareDefinitions() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreparedStatementTracking(t *testing.T) {
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_STMT_PREPARE}, "SELECT name, email FROM users WHERE id = ?"...)), time.Now())
+	if rs.preparing != "SELECT name email FROM users WHERE id = ?" {
+		t.Errorf("preparing = %q", rs.preparing)
+	}
+
+	// PREPARE_OK for statement 7, then one parameter, EOF, two columns, EOF,
+	// split so the definitions arrive in a second segment
+	eof := []byte{MYSQL_EOF_PACKET, 0x00, 0x00, 0x02, 0x00}
+	processResponse(rs, mysqlPacket(1, prepareOKPacket(7, 2, 1)), time.Now())
+	if rs.reqSent == nil {
+		t.Fatalf("response finished before the definitions arrived")
+	}
+	var rest []byte
+	for i, pkt := range [][]byte{columnDefPacket("?", mysql.MYSQL_TYPE_LONGLONG), eof, columnDefPacket("name", mysql.MYSQL_TYPE_VAR_STRING), columnDefPacket("email", mysql.MYSQL_TYPE_VAR_STRING), eof} {
+		rest = append(rest, mysqlPacket(byte(i+2), pkt)...)
+	}
+	processResponse(rs, rest, time.Now())
+
+	if rs.reqSent != nil {
+		t.Errorf("response still pending after the last definition")
+	}
+	if got := rs.preparedStmts[7]; got != "SELECT name email FROM users WHERE id = ?" {
+		t.Errorf("preparedStmts[7] = %q", got)
+	}
+
+	// A failed prepare records nothing
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_STMT_PREPARE}, "SELEC 1"...)), time.Now())
+	processResponse(rs, mysqlPacket(1, []byte{0xff, 0x28, 0x04, '#', '4', '2', '0', '0', '0', 'x'}), time.Now())
+	if len(rs.preparedStmts) != 1 || rs.preparing != "" {
+		t.Errorf("preparedStmts = %v, preparing = %q after a failed prepare", rs.preparedStmts, rs.preparing)
+	}
+
+	// Statement 7 prepared again without a close: remapped, with a warning
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_STMT_PREPARE}, "DELETE FROM users WHERE id = ?"...)), time.Now())
+	processResponse(rs, append(mysqlPacket(1, prepareOKPacket(7, 0, 1)), append(mysqlPacket(2, columnDefPacket("?", mysql.MYSQL_TYPE_LONGLONG)), mysqlPacket(3, eof)...)...), time.Now())
+	if got := rs.preparedStmts[7]; got != "DELETE FROM users WHERE id = ?" {
+		t.Errorf("preparedStmts[7] = %q after preparing it again", got)
+	}
+	if !strings.Contains(out.String(), "Statement 7 on 10.0.0.1:5000 prepared again without COM_STMT_CLOSE: DELETE FROM users WHERE id = ? (was SELECT name email FROM users WHERE id = ?)") {
+		t.Errorf("missing re-prepare warning:\n%s", out.String())
+	}
+
+	processRequest(rs, mysqlPacket(0, []byte{mysql.COM_STMT_CLOSE, 7, 0, 0, 0}), time.Now())
+	if _, ok := rs.preparedStmts[7]; ok {
+		t.Errorf("statement 7 still tracked after COM_STMT_CLOSE")
+	}
+}
+
+func TestExecuteResolvesPreparedSQL(t *testing.T) {
+	savedDirty := dirty
+	defer func() { dirty = savedDirty }()
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	rs.preparedStmts = map[uint32]string{7: "SELECT name email FROM users WHERE id = ?"}
+
+	// Statement 7, no cursor, one iteration, then the bound parameter
+	execute := func(id byte) []byte {
+		return mysqlPacket(0, []byte{mysql.COM_STMT_EXECUTE, id, 0, 0, 0, 0x00, 1, 0, 0, 0, 0x00, 0x01, mysql.MYSQL_TYPE_LONGLONG, 0x00, 42, 0, 0, 0, 0, 0, 0, 0})
+	}
+
+	processRequest(rs, execute(7), time.Now())
+	if rs.qText != "SELECT name email FROM users WHERE id = ?" {
+		t.Errorf("known statement: qText = %q", rs.qText)
+	}
+	if rs.qBytes != 21 {
+		t.Errorf("known statement: qBytes = %d, want 21", rs.qBytes)
+	}
+	processResponse(rs, mysqlPacket(1, okPacket(0)), time.Now())
+
+	dirty = true
+	processRequest(rs, execute(9), time.Now())
+	if rs.qText != "EXECUTE(stmt=9)" {
+		t.Errorf("unknown statement: qText = %q, want EXECUTE(stmt=9)", rs.qText)
+	}
+}
+
+func TestStmtResetClearsLongData(t *testing.T) {
+	savedStats := stats
+	defer func() { stats = savedStats }()
+	stats.stmtResets = 0
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	rs.preparedStmts = map[uint32]string{3: "INSERT INTO docs (body) VALUES (?)"}
+
+	longData := func(id byte, chunk string) []byte {
+		return mysqlPacket(0, append([]byte{mysql.COM_STMT_SEND_LONG_DATA, id, 0, 0, 0, 0, 0}, chunk...))
+	}
+	processRequest(rs, longData(3, "first half "), time.Now())
+	processRequest(rs, longData(3, "second half"), time.Now())
+	if rs.longData[3] != 22 {
+		t.Errorf("longData[3] = %d, want 22", rs.longData[3])
+	}
+
+	processRequest(rs, mysqlPacket(0, []byte{mysql.COM_STMT_RESET, 3, 0, 0, 0}), time.Now())
+	if _, ok := rs.longData[3]; ok {
+		t.Errorf("long data for statement 3 still buffered after COM_STMT_RESET")
+	}
+	if stats.stmtResets != 1 {
+		t.Errorf("stmtResets = %d, want 1", stats.stmtResets)
+	}
+	if rs.reqSent == nil {
+		t.Errorf("COM_STMT_RESET not waiting for its OK")
+	}
+	processResponse(rs, mysqlPacket(1, okPacket(0)), time.Now())
+	if _, ok := rs.preparedStmts[3]; !ok {
+		t.Errorf("COM_STMT_RESET closed the statement")
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	handleStatusUpdate()
+	if !strings.Contains(out.String(), "1 COM_STMT_RESET") {
+		t.Errorf("status update missing the reset count:\n%s", out.String())
+	}
+}
+
+// prepareStatement runs a COM_STMT_PREPARE of query on rs, answered with
+// PREPARE_OK for id (no parameters or columns)
+func prepareStatement(rs *source, query string, id uint32, sent, answered time.Time) {
+	processRequest(rs, mysqlPacket(0, append([]byte{mysql.COM_STMT_PREPARE}, query...)), sent)
+	processResponse(rs, mysqlPacket(1, prepareOKPacket(id, 0, 0)), answered)
+}
+
+// executeStatement runs a COM_STMT_EXECUTE of id on rs, answered with an OK
+func executeStatement(rs *source, id uint32, sent, answered time.Time) {
+	payload := binary.LittleEndian.AppendUint32([]byte{mysql.COM_STMT_EXECUTE}, id)
+	processRequest(rs, mysqlPacket(0, append(payload, 0x00, 1, 0, 0, 0)), sent)
+	processResponse(rs, mysqlPacket(1, okPacket(0)), answered)
+}
+
+func TestPreparedShapeReuse(t *testing.T) {
+	savedBy, savedShapes := byPrepared, preparedShapes
+	defer func() { byPrepared, preparedShapes = savedBy, savedShapes }()
+	byPrepared = true
+	preparedShapes = make(map[string]*preparedShape)
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	now := time.Now()
+
+	// Prepared once, executed ten times
+	prepareStatement(rs, "SELECT * FROM users WHERE id = ?", 1, now, now)
+	for range 10 {
+		executeStatement(rs, 1, now, now)
+	}
+	// Prepared afresh for every execute
+	for i := range 5 {
+		prepareStatement(rs, "UPDATE users SET seen = NOW() WHERE id = ?", uint32(2+i), now, now)
+		executeStatement(rs, uint32(2+i), now, now)
+	}
+	// An execute of a statement prepared before the capture counts nowhere
+	executeStatement(rs, 99, now, now)
+
+	reused, rePrepared := preparedShapes["SELECT * FROM users WHERE id = ?"], preparedShapes["UPDATE users SET seen = NOW() WHERE id = ?"]
+	if reused == nil || reused.prepares != 1 || reused.executes != 10 || reused.noReuse() {
+		t.Errorf("1 prepare/10 executes shape = %+v", reused)
+	}
+	if rePrepared == nil || rePrepared.prepares != 5 || rePrepared.executes != 5 || !rePrepared.noReuse() {
+		t.Errorf("5 prepares/5 executes shape = %+v", rePrepared)
+	}
+	if len(preparedShapes) != 2 {
+		t.Errorf("preparedShapes has %d shapes, want 2", len(preparedShapes))
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	reportPreparedShapes()
+	report := out.String()
+	if !strings.Contains(report, "1 prepared statement shape(s) re-prepared for nearly every execute") ||
+		!strings.Contains(report, "UPDATE users SET seen = NOW() WHERE id = ?"+COLOR_YELLOW+" [no reuse]") {
+		t.Errorf("report doesn't flag the re-prepared shape:\n%s", report)
+	}
+	if strings.Count(report, "[no reuse]") != 1 {
+		t.Errorf("%d shapes flagged, want 1:\n%s", strings.Count(report, "[no reuse]"), report)
+	}
+}
+
+func TestPreparedShapeLatency(t *testing.T) {
+	savedBy, savedShapes := byPrepared, preparedShapes
+	defer func() { byPrepared, preparedShapes = savedBy, savedShapes }()
+	byPrepared = true
+	preparedShapes = make(map[string]*preparedShape)
+	format = nil
+	parseFormat("#q")
+	rs := &source{hostPort: "10.0.0.1:5000", srcIP: "10.0.0.1", synced: true}
+	now := time.Now()
+
+	// A slow prepare, then two quick executes
+	prepareStatement(rs, "SELECT * FROM orders WHERE customer = ?", 1, now, now.Add(8*time.Millisecond))
+	executeStatement(rs, 1, now, now.Add(time.Millisecond))
+	executeStatement(rs, 1, now, now.Add(3*time.Millisecond))
+
+	shape := preparedShapes["SELECT * FROM orders WHERE customer = ?"]
+	if shape == nil {
+		t.Fatalf("shape not tracked: %v", preparedShapes)
+	}
+	if shape.prepareTime != uint64(8*time.Millisecond) {
+		t.Errorf("prepareTime = %v, want 8ms", time.Duration(shape.prepareTime))
+	}
+	if shape.executeTime != uint64(4*time.Millisecond) || shape.executesTimed != 2 {
+		t.Errorf("executeTime = %v over %d executes, want 4ms over 2", time.Duration(shape.executeTime), shape.executesTimed)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	reportPreparedShapes()
+	if !strings.Contains(out.String(), "       1        2      2.0      8.000      2.000  SELECT * FROM orders WHERE customer = ?") {
+		t.Errorf("report missing the separate latencies:\n%s", out.String())
+	}
+}
+
+// ========== Display Time Zone Tests ==========
+
+func TestConvertTimeZone(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{"2024-03-01 08:30:00", "2024-02-29 23:30:00"},
+		{"2024-03-01 08:30:00.125000", "2024-02-29 23:30:00.125000"},
+		{"0000-00-00 00:00:00", "0000-00-00 00:00:00"},
+		{"not a time", "not a time"},
+	}
+	for _, tt := range tests {
+		if got := convertTimeZone(tt.val, tokyo, time.UTC); got != tt.want {
+			t.Errorf("convertTimeZone(%q) = %q, want %q", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestDisplayTimeZone(t *testing.T) {
+	savedDisplay, savedSession := displayTZ, sessionTZ
+	defer func() { displayTZ, sessionTZ = savedDisplay, savedSession }()
+	displayTZ, sessionTZ = time.UTC, time.FixedZone("EST", -5*60*60)
+
+	created := columnDefinition{name: "created_at", colType: mysql.MYSQL_TYPE_TIMESTAMP}
+	if got := formatColumnValue(created, "2024-12-31 21:15:00", ""); got != "2025-01-01 02:15:00" {
+		t.Errorf("TIMESTAMP shown as %q, want 2025-01-01 02:15:00", got)
+	}
+	name := columnDefinition{name: "name", colType: mysql.MYSQL_TYPE_VAR_STRING}
+	if got := formatColumnValue(name, "2024-12-31 21:15:00", ""); got != "2024-12-31 21:15:00" {
+		t.Errorf("string column converted to %q", got)
+	}
+
+	displayTZ = nil
+	if got := formatColumnValue(created, "2024-12-31 21:15:00", ""); got != "2024-12-31 21:15:00" {
+		t.Errorf("converted without -display-tz: %q", got)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// Packets the server sends during authentication, besides OK and ERROR
+const (
+	AUTH_MORE_DATA      = 0x01
+	AUTH_SWITCH_REQUEST = 0xfe
+
+	// caching_sha2_password status bytes, sent in an AuthMoreData packet
+	CACHING_SHA2_FAST_AUTH_SUCCESS = 0x03
+	CACHING_SHA2_PERFORM_FULL_AUTH = 0x04
+)
+
+// handshakeResponse holds what we learn from the client's HandshakeResponse41
+type handshakeResponse struct {
+	capabilities uint32
+	plugin       string
+
+	// connection attributes such as _client_name and program_name, if the
+	// client sent any (CLIENT_CONNECT_ATTRS)
+	attrs map[string]string
+
+	// sslRequest is set for the truncated response a client sends before
+	// switching to TLS; everything after it is encrypted.
+	sslRequest bool
+}
+
+// parseHandshakeResponse recognizes a HandshakeResponse41 payload (the client's
+// reply to the server greeting) and extracts the negotiated capability flags.
+// Layout: capabilities (4), max packet size (4), character set (1), 23 zero
+// bytes of filler, then the username and auth data.
+func parseHandshakeResponse(payload []byte) (handshakeResponse, bool) {
+	if len(payload) < 32 {
+		return handshakeResponse{}, false
+	}
+
+	capabilities := binary.LittleEndian.Uint32(payload[0:4])
+	if capabilities&mysql.CLIENT_PROTOCOL_41 == 0 {
+		return handshakeResponse{}, false
+	}
+
+	// The zero filler is what tells a handshake response apart from a command
+	// packet that happens to be long enough.
+	for _, b := range payload[9:32] {
+		if b != 0 {
+			return handshakeResponse{}, false
+		}
+	}
+
+	hs := handshakeResponse{capabilities: capabilities}
+	if len(payload) == 32 {
+		hs.sslRequest = capabilities&mysql.CLIENT_SSL != 0
+		return hs, true
+	}
+	hs.plugin, hs.attrs = parseHandshakeTail(payload[32:], capabilities)
+	return hs, true
+}
+
+// isHandshakeResponse reports whether a request segment starts with a
+// complete handshake response packet
+func isHandshakeResponse(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+	if len(data) < size+4 {
+		return false
+	}
+	_, ok := parseHandshakeResponse(data[4 : size+4])
+	return ok
+}
+
+// parseHandshakeTail walks the variable part of a handshake response:
+// username, auth response, database, plugin name, then connection
+// attributes. Each field is only present with its capability flag; whatever
+// is missing or cut short comes back empty.
+func parseHandshakeTail(rest []byte, capabilities uint32) (plugin string, attrs map[string]string) {
+	skipNulString := func() bool {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return false
+		}
+		rest = rest[end+1:]
+		return true
+	}
+
+	if !skipNulString() { // username
+		return "", nil
+	}
+
+	switch {
+	case capabilities&mysql.CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA != 0:
+		n, _, size := mysql.LengthEncodedInt(rest)
+		if size == 0 || uint64(len(rest)-size) < n {
+			return "", nil
+		}
+		rest = rest[size+int(n):]
+	case capabilities&mysql.CLIENT_SECURE_CONNECTION != 0:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return "", nil
+		}
+		rest = rest[1+int(rest[0]):]
+	default:
+		if !skipNulString() {
+			return "", nil
+		}
+	}
+
+	if capabilities&mysql.CLIENT_CONNECT_WITH_DB != 0 && !skipNulString() {
+		return "", nil
+	}
+
+	if capabilities&mysql.CLIENT_PLUGIN_AUTH != 0 {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return string(rest), nil
+		}
+		plugin = string(rest[:end])
+		rest = rest[end+1:]
+	}
+
+	if capabilities&mysql.CLIENT_CONNECT_ATTRS != 0 {
+		attrs = parseConnectAttrs(rest)
+	}
+	return plugin, attrs
+}
+
+// parseConnectAttrs decodes the connection attributes block: its total
+// length, then length-encoded key and value strings. Returns the pairs read
+// before anything malformed.
+func parseConnectAttrs(data []byte) map[string]string {
+	total, _, size := mysql.LengthEncodedInt(data)
+	if size == 0 || uint64(len(data)-size) < total {
+		return nil
+	}
+	data = data[size : size+int(total)]
+
+	attrs := make(map[string]string)
+	for len(data) > 0 {
+		key, _, n, err := mysql.LengthEncodedString(data)
+		if err != nil {
+			break
+		}
+		data = data[n:]
+		value, _, n, err := mysql.LengthEncodedString(data)
+		if err != nil {
+			break
+		}
+		data = data[n:]
+		attrs[string(key)] = string(value)
+	}
+	return attrs
+}
+
+// authPhase is where a connection is in its authentication exchange
+type authPhase int
+
+const (
+	authUnknown authPhase = iota // never saw it start, e.g. joined mid-stream
+	authPending                  // waiting for the server's final OK or ERROR
+	authDone
+	authFailed
+)
+
+// authState follows the authentication exchange of one connection. After the
+// handshake response the server may answer with any number of intermediate
+// packets before the final OK or ERROR:
+//
+//   - AuthSwitchRequest (0xfe) names another plugin; the client answers with
+//     that plugin's auth data (a cleartext password for mysql_clear_password).
+//   - AuthMoreData (0x01) carries plugin data. For caching_sha2_password it's
+//     either fast-auth success (0x03), with the OK still to come, or a request
+//     for full authentication (0x04), after which the client sends its
+//     password over TLS or asks for the server's public key (0x02) and sends
+//     it encrypted.
+//
+// Only the final OK marks the connection authenticated.
+type authState struct {
+	phase    authPhase
+	plugin   string
+	fullAuth bool
+}
+
+// start begins tracking an authentication exchange using the given plugin
+func (a *authState) start(plugin string) {
+	*a = authState{phase: authPending, plugin: plugin}
+}
+
+// serverPacket advances the exchange on a packet from the server
+func (a *authState) serverPacket(payload []byte) {
+	if a.phase != authPending || len(payload) == 0 {
+		return
+	}
+
+	switch payload[0] {
+	case MYSQL_OK_PACKET:
+		a.phase = authDone
+	case MYSQL_ERR_PACKET:
+		a.phase = authFailed
+	case AUTH_SWITCH_REQUEST:
+		plugin := payload[1:]
+		if end := bytes.IndexByte(plugin, 0); end >= 0 {
+			plugin = plugin[:end]
+		}
+		a.plugin = string(plugin)
+		a.fullAuth = false
+	case AUTH_MORE_DATA:
+		// Anything longer is plugin data, such as the server's public key
+		if len(payload) == 2 && payload[1] == CACHING_SHA2_PERFORM_FULL_AUTH {
+			a.fullAuth = true
+		}
+	}
+}
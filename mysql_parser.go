@@ -2,20 +2,45 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"math"
 	"strings"
+	"time"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
 )
 
 // MySQL packet types for responses
 const (
-	MYSQL_OK_PACKET  = 0x00
-	MYSQL_EOF_PACKET = 0xfe
-	MYSQL_ERR_PACKET = 0xff
+	MYSQL_OK_PACKET           = 0x00
+	MYSQL_LOCAL_INFILE_PACKET = 0xfb
+	MYSQL_EOF_PACKET          = 0xfe
+	MYSQL_ERR_PACKET          = 0xff
+
+	// metadata_follows values with CLIENT_OPTIONAL_RESULTSET_METADATA
+	RESULTSET_METADATA_NONE = 0x00
+	RESULTSET_METADATA_FULL = 0x01
 )
 
+// responseAffectedRows totals the affected rows of the OK packets a response
+// starts with: one for a single write, one per statement for a
+// multi-statement batch. Anything else, such as a result set or an error,
+// changed nothing we can count.
+func responseAffectedRows(responseData []byte) uint64 {
+	var total uint64
+	for _, packet := range collectAllResponsePackets(responseData) {
+		if len(packet) < 2 || packet[0] != MYSQL_OK_PACKET {
+			break
+		}
+		rows, _, _ := mysql.LengthEncodedInt(packet[1:])
+		total += rows
+	}
+	return total
+}
+
 // parseOKPacket parses a MySQL OK packet
 func parseOKPacket(data []byte) string {
 	if len(data) < 7 {
@@ -51,8 +76,75 @@ func parseOKPacket(data []byte) string {
 	return result.String()
 }
 
+// Errors a server sends when LOAD DATA LOCAL is refused because local_infile
+// is disabled: 1148 before MySQL 8.0, 3948 since
+const (
+	ER_NOT_ALLOWED_COMMAND         = mysql.ER_NOT_ALLOWED_COMMAND
+	ER_CLIENT_LOCAL_FILES_DISABLED = 3948
+)
+
+// MariaDB reports the progress of long statements (ALTER TABLE, LOAD DATA
+// and the like) in ERROR packets with this code, ahead of the real response
+const MARIADB_PROGRESS_REPORT = 0xffff
+
+// progressReport is a MariaDB progress report: error code 0xffff, then the
+// stage, the number of stages, the progress through the stage in thousandths
+// of a percent (3 bytes) and a length-encoded description
+type progressReport struct {
+	stage    uint8
+	maxStage uint8
+	progress uint32
+	info     string
+}
+
+// parseProgressReport recognizes a MariaDB progress report packet
+func parseProgressReport(pkt []byte) (progressReport, bool) {
+	if code, ok := errorPacketCode(pkt); !ok || code != MARIADB_PROGRESS_REPORT || len(pkt) < 8 {
+		return progressReport{}, false
+	}
+	p := progressReport{
+		stage:    pkt[3],
+		maxStage: pkt[4],
+		progress: uint32(pkt[5]) | uint32(pkt[6])<<8 | uint32(pkt[7])<<16,
+	}
+	if info, _, _, err := mysql.LengthEncodedString(pkt[8:]); err == nil {
+		p.info = string(info)
+	}
+	return p, true
+}
+
+func (p progressReport) String() string {
+	text := fmt.Sprintf("%sProgress: stage %d/%d, %.1f%%%s", COLOR_CYAN, p.stage, p.maxStage, float64(p.progress)/1000, COLOR_DEFAULT)
+	if p.info != "" {
+		text += " (" + p.info + ")"
+	}
+	return text
+}
+
+// errorPacketCode returns the error code of an ERROR packet
+func errorPacketCode(pkt []byte) (uint16, bool) {
+	if len(pkt) < 3 || pkt[0] != MYSQL_ERR_PACKET {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(pkt[1:3]), true
+}
+
+// isLocalInfileDisabled reports whether a response is the error refusing a
+// LOAD DATA LOCAL because the server has local_infile turned off
+func isLocalInfileDisabled(responseData []byte) bool {
+	packets := collectAllResponsePackets(responseData)
+	if len(packets) == 0 {
+		return false
+	}
+	code, ok := errorPacketCode(packets[0])
+	return ok && (code == ER_NOT_ALLOWED_COMMAND || code == ER_CLIENT_LOCAL_FILES_DISABLED)
+}
+
 // parseErrorPacket parses a MySQL ERROR packet
 func parseErrorPacket(data []byte) string {
+	if p, ok := parseProgressReport(data); ok {
+		return p.String()
+	}
 	if len(data) < 9 {
 		return "ERROR"
 	}
@@ -80,6 +172,38 @@ func parseErrorPacket(data []byte) string {
 	return fmt.Sprintf("%sERROR %d: %s%s", COLOR_RED, errorCode, message, COLOR_DEFAULT)
 }
 
+// eofPacket holds the contents of a (pre-CLIENT_DEPRECATE_EOF) EOF packet
+type eofPacket struct {
+	warnings    uint16
+	statusFlags uint16
+}
+
+// parseEOFPacket reads the warning count and status flags that follow the
+// 0xfe byte of an EOF packet
+func parseEOFPacket(pkt []byte) (eofPacket, bool) {
+	if !isEOFPacket(pkt) || len(pkt) < 5 {
+		return eofPacket{}, false
+	}
+	return eofPacket{
+		warnings:    binary.LittleEndian.Uint16(pkt[1:3]),
+		statusFlags: binary.LittleEndian.Uint16(pkt[3:5]),
+	}, true
+}
+
+// notes describes the warnings and execution status flags worth showing
+func (e eofPacket) notes() []string {
+	var notes []string
+	if e.statusFlags&mysql.SERVER_STATUS_NO_INDEX_USED != 0 {
+		notes = append(notes, "no index used")
+	} else if e.statusFlags&mysql.SERVER_STATUS_NO_GOOD_INDEX_USED != 0 {
+		notes = append(notes, "no good index used")
+	}
+	if e.warnings > 0 {
+		notes = append(notes, fmt.Sprintf("%d warning(s)", e.warnings))
+	}
+	return notes
+}
+
 // parseResultSetPacket parses a MySQL result set and returns all rows
 func parseResultSetPacket(data []byte, showRows bool) string {
 	if len(data) < 1 {
@@ -98,8 +222,25 @@ func parseResultSetPacket(data []byte, showRows bool) string {
 	return result.String()
 }
 
+// parseColumnCount parses the first packet of a result set. With
+// CLIENT_OPTIONAL_RESULTSET_METADATA the column count is followed by a
+// metadata_follows byte, and the column definitions are only sent when it is
+// RESULTSET_METADATA_FULL (1).
+func parseColumnCount(pkt []byte, capabilities uint32) (count uint64, metadata bool, ok bool) {
+	count, _, n := mysql.LengthEncodedInt(pkt)
+	if n == 0 {
+		return 0, false, false
+	}
+
+	metadata = true
+	if capabilities&mysql.CLIENT_OPTIONAL_RESULTSET_METADATA != 0 && n < len(pkt) {
+		metadata = pkt[n] == RESULTSET_METADATA_FULL
+	}
+	return count, metadata, true
+}
+
 // parseResultSetFull parses complete result set including field definitions and rows
-func parseResultSetFull(packets [][]byte, showRows bool) string {
+func parseResultSetFull(packets [][]byte, capabilities uint32, showRows bool, charset string) string {
 	if len(packets) < 2 {
 		return "Incomplete result set"
 	}
@@ -107,33 +248,51 @@ func parseResultSetFull(packets [][]byte, showRows bool) string {
 	var result strings.Builder
 
 	// First packet: column count
-	columnCount, _, n := mysql.LengthEncodedInt(packets[0])
-	if n == 0 || columnCount == 0 {
+	columnCount, metadata, ok := parseColumnCount(packets[0], capabilities)
+	if !ok || columnCount == 0 {
 		return "Result set with 0 columns"
 	}
 
 	// Parse column definitions
-	var columns []string
+	var columns []columnDefinition
+	var columnNames []string
 	pktIdx := 1
-	for i := uint64(0); i < columnCount && pktIdx < len(packets); i++ {
+	for i := uint64(0); metadata && i < columnCount && pktIdx < len(packets); i++ {
 		pkt := packets[pktIdx]
 		if len(pkt) > 0 && pkt[0] == MYSQL_EOF_PACKET {
 			break
 		}
 
-		colName := parseColumnDefinition(pkt)
-		columns = append(columns, colName)
+		col := parseColumnDefinition(pkt)
+		columns = append(columns, col)
+		columnNames = append(columnNames, col.name)
 		pktIdx++
 	}
 
 	result.WriteString(fmt.Sprintf("%sResultSet: %d column(s)%s", COLOR_GREEN, columnCount, COLOR_DEFAULT))
 
 	if len(columns) > 0 {
-		result.WriteString(fmt.Sprintf(" [%s%s%s]", COLOR_CYAN, strings.Join(columns, ", "), COLOR_DEFAULT))
+		result.WriteString(fmt.Sprintf(" [%s%s%s]", COLOR_CYAN, strings.Join(columnNames, ", "), COLOR_DEFAULT))
 	}
 
-	// Skip EOF packet after column definitions (MySQL < 5.7 or when CLIENT_DEPRECATE_EOF not set)
+	// Without metadata we only know the column count; name the columns by
+	// position so rows can still be shown.
+	if !metadata {
+		result.WriteString(fmt.Sprintf(" [%smetadata omitted%s]", COLOR_YELLOW, COLOR_DEFAULT))
+		for i := uint64(0); i < columnCount; i++ {
+			columns = append(columns, columnDefinition{name: fmt.Sprintf("col%d", i+1)})
+		}
+	}
+
+	// EOF packet after column definitions (MySQL < 5.7 or when
+	// CLIENT_DEPRECATE_EOF not set). Its status flags already tell us how
+	// the server executed the query.
 	if pktIdx < len(packets) && len(packets[pktIdx]) > 0 && packets[pktIdx][0] == MYSQL_EOF_PACKET {
+		if eof, ok := parseEOFPacket(packets[pktIdx]); ok {
+			for _, note := range eof.notes() {
+				result.WriteString(fmt.Sprintf(" [%s%s%s]", COLOR_YELLOW, note, COLOR_DEFAULT))
+			}
+		}
 		pktIdx++
 	}
 
@@ -165,12 +324,16 @@ func parseResultSetFull(packets [][]byte, showRows bool) string {
 				rowCount++
 				result.WriteString(fmt.Sprintf("      %sRow %d:%s ", COLOR_YELLOW, rowCount, COLOR_DEFAULT))
 				for i, val := range rowData {
+					if maxColumnsDisplayed > 0 && i == maxColumnsDisplayed {
+						result.WriteString(fmt.Sprintf(", %s…(+%d more)%s", COLOR_YELLOW, len(rowData)-i, COLOR_DEFAULT))
+						break
+					}
 					if i > 0 {
 						result.WriteString(", ")
 					}
 					result.WriteString(fmt.Sprintf("%s%s%s=%s%s%s",
-						COLOR_CYAN, columns[i], COLOR_DEFAULT,
-						COLOR_WHITE, val, COLOR_DEFAULT))
+						COLOR_CYAN, columns[i].label(), COLOR_DEFAULT,
+						COLOR_WHITE, truncateValue(formatColumnValue(columns[i], val, charset), maxValueWidth), COLOR_DEFAULT))
 				}
 				result.WriteString("\n")
 			}
@@ -188,8 +351,35 @@ func parseResultSetFull(packets [][]byte, showRows bool) string {
 	return result.String()
 }
 
-// parseColumnDefinition extracts column name from field packet
-func parseColumnDefinition(data []byte) string {
+// columnDefinition holds the parts of a field packet we use for display
+type columnDefinition struct {
+	name      string
+	charsetID uint16
+	colType   byte
+	flags     uint16
+}
+
+// label is the column name annotated with its key and auto-increment
+// flags, e.g. id(PK,AI)
+func (c columnDefinition) label() string {
+	var notes []string
+	if c.flags&mysql.PRI_KEY_FLAG != 0 {
+		notes = append(notes, "PK")
+	}
+	if c.flags&mysql.UNIQUE_KEY_FLAG != 0 {
+		notes = append(notes, "UK")
+	}
+	if c.flags&mysql.AUTO_INCREMENT_FLAG != 0 {
+		notes = append(notes, "AI")
+	}
+	if len(notes) == 0 {
+		return c.name
+	}
+	return c.name + "(" + strings.Join(notes, ",") + ")"
+}
+
+// parseColumnDefinition extracts column name, type and flags from field packet
+func parseColumnDefinition(data []byte) columnDefinition {
 	pos := 0
 
 	// Skip catalog
@@ -209,9 +399,168 @@ func parseColumnDefinition(data []byte) string {
 	pos += n
 
 	// Get column name
-	name, _, _, _ := mysql.LengthEncodedString(data[pos:])
+	name, _, n, _ := mysql.LengthEncodedString(data[pos:])
+	pos += n
+	col := columnDefinition{name: string(name)}
+
+	// Skip org_name
+	_, _, n, _ = mysql.LengthEncodedString(data[pos:])
+	pos += n
+
+	// Fixed-length fields: length of fixed fields (always 0x0c), character
+	// set (2), column length (4), then the column type (1) and flags (2)
+	if pos+3 <= len(data) {
+		col.charsetID = binary.LittleEndian.Uint16(data[pos+1 : pos+3])
+	}
+	pos += 1 + 2 + 4
+	if pos < len(data) {
+		col.colType = data[pos]
+	}
+	if pos+3 <= len(data) {
+		col.flags = binary.LittleEndian.Uint16(data[pos+1 : pos+3])
+	}
+
+	return col
+}
+
+// formatColumnValue renders a text-protocol value for display, decoding the
+// column types that don't print well as-is and text sent in the session's
+// result character set
+func formatColumnValue(col columnDefinition, val string, charset string) string {
+	if val == "NULL" {
+		return val
+	}
+
+	switch {
+	case col.colType == mysql.MYSQL_TYPE_GEOMETRY:
+		return formatGeometry([]byte(val))
+	case displayTZ != nil && (col.colType == mysql.MYSQL_TYPE_DATETIME || col.colType == mysql.MYSQL_TYPE_TIMESTAMP):
+		return convertTimeZone(val, sessionTZ, displayTZ)
+	case col.charsetID == BINARY_CHARSET_ID:
+		return val
+	default:
+		return decodeCharset(charset, val)
+	}
+}
+
+// convertTimeZone rewrites a DATETIME or TIMESTAMP value, as sent in the
+// session's time zone, in another zone, keeping its fractional digits. Zero
+// dates and anything else that doesn't parse are left alone.
+func convertTimeZone(val string, from, to *time.Location) string {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", val, from)
+	if err != nil {
+		return val
+	}
+	layout := "2006-01-02 15:04:05"
+	if dot := strings.IndexByte(val, '.'); dot >= 0 {
+		layout += "." + strings.Repeat("0", len(val)-dot-1)
+	}
+	return t.In(to).Format(layout)
+}
+
+// truncateValue shortens a displayed value to at most width characters (not
+// bytes, so multibyte text isn't cut mid-character), marking the cut with an
+// ellipsis. A width of 0 means no limit.
+func truncateValue(val string, width int) string {
+	if width <= 0 {
+		return val
+	}
+	chars := 0
+	for i := range val {
+		if chars == width {
+			return val[:i] + "…"
+		}
+		chars++
+	}
+	return val
+}
 
-	return string(name)
+// isControlByte reports whether b is an ASCII control character other than
+// the tab and line breaks a query can legitimately contain
+func isControlByte(b byte) bool {
+	return (b < 0x20 && b != '\t' && b != '\n' && b != '\r') || b == 0x7f
+}
+
+// hasControlBytes reports whether a query contains a NUL or other control byte
+func hasControlBytes(query []byte) bool {
+	for _, b := range query {
+		if isControlByte(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeControlBytes makes a query safe to print by writing NULs and other
+// control bytes as \xNN, so they can't garble a terminal or a log consumer
+func escapeControlBytes(query string) string {
+	if !hasControlBytes([]byte(query)) {
+		return query
+	}
+	var out strings.Builder
+	for i := 0; i < len(query); i++ {
+		if isControlByte(query[i]) {
+			fmt.Fprintf(&out, "\\x%02x", query[i])
+		} else {
+			out.WriteByte(query[i])
+		}
+	}
+	return out.String()
+}
+
+// formatGeometry summarizes a GEOMETRY value, which MySQL sends as a 4-byte
+// SRID followed by WKB. Points show their coordinates; other shapes show how
+// many points or member geometries they hold. Anything we can't decode is
+// shown as hex.
+func formatGeometry(val []byte) string {
+	// SRID (4) + byte order (1) + geometry type (4)
+	if len(val) < 9 {
+		return fmt.Sprintf("0x%x", val)
+	}
+
+	srid := binary.LittleEndian.Uint32(val[0:4])
+	var order binary.ByteOrder = binary.LittleEndian
+	if val[4] == 0 {
+		order = binary.BigEndian
+	}
+	geomType := order.Uint32(val[5:9])
+	body := val[9:]
+
+	switch geomType {
+	case 1:
+		if len(body) < 16 {
+			break
+		}
+		x := math.Float64frombits(order.Uint64(body[0:8]))
+		y := math.Float64frombits(order.Uint64(body[8:16]))
+		return fmt.Sprintf("POINT(%g %g) SRID=%d", x, y, srid)
+	case 2:
+		if len(body) < 4 {
+			break
+		}
+		return fmt.Sprintf("LINESTRING(%d points) SRID=%d", order.Uint32(body), srid)
+	case 3:
+		if len(body) < 4 {
+			break
+		}
+		rings := order.Uint32(body)
+		pos := 4
+		points := uint32(0)
+		for i := uint32(0); i < rings && pos+4 <= len(body); i++ {
+			n := order.Uint32(body[pos:])
+			points += n
+			pos += 4 + int(n)*16
+		}
+		return fmt.Sprintf("POLYGON(%d rings, %d points) SRID=%d", rings, points, srid)
+	case 4, 5, 6, 7:
+		if len(body) < 4 {
+			break
+		}
+		names := map[uint32]string{4: "MULTIPOINT", 5: "MULTILINESTRING", 6: "MULTIPOLYGON", 7: "GEOMETRYCOLLECTION"}
+		return fmt.Sprintf("%s(%d geometries) SRID=%d", names[geomType], order.Uint32(body), srid)
+	}
+
+	return fmt.Sprintf("0x%x", val)
 }
 
 // parseRowData extracts values from a row data packet
@@ -282,12 +631,38 @@ func collectAllResponsePackets(buffer []byte) [][]byte {
 	return packets
 }
 
-// displayQueryResult displays a formatted query and its result
-func displayQueryResult(src string, query string, responseData []byte, reqTime uint64, qbytes uint64, showRows bool) {
-	if !verbose {
-		return
+// isEOFPacket reports whether a packet is an EOF (or an OK packet standing in
+// for one). A row can only start with 0xfe if its first value needs an 8-byte
+// length, which makes the packet at least 16MB, so anything shorter is EOF.
+func isEOFPacket(pkt []byte) bool {
+	return len(pkt) > 0 && pkt[0] == MYSQL_EOF_PACKET && len(pkt) < 0xffffff
+}
+
+// maxHexdumpBytes is how much of an unrecognized response -hexdump-unrecognized shows
+const maxHexdumpBytes = 256
+
+// boundedHexdump formats at most limit bytes of data as an indented hex dump,
+// noting how much was left out
+func boundedHexdump(data []byte, limit int) string {
+	shown := data
+	if len(shown) > limit {
+		shown = shown[:limit]
 	}
 
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(hex.Dump(shown), "\n") {
+		if line != "" {
+			out.WriteString("    " + line)
+		}
+	}
+	if len(data) > limit {
+		out.WriteString(fmt.Sprintf("    ... %d more bytes\n", len(data)-limit))
+	}
+	return out.String()
+}
+
+// displayQueryResult displays a formatted query and its result
+func displayQueryResult(src string, query string, responseData []byte, reqTime uint64, qbytes uint64, capabilities uint32, showRows bool, charset string) {
 	var output bytes.Buffer
 
 	// Display source
@@ -299,25 +674,69 @@ func displayQueryResult(src string, query string, responseData []byte, reqTime u
 		COLOR_GREEN, float64(reqTime)/1000000, COLOR_DEFAULT,
 		COLOR_CYAN, qbytes, COLOR_DEFAULT))
 
-	output.WriteString(fmt.Sprintf("  %sQuery:%s %s%s%s\n",
+	// Pretty-printing only changes what we show; continuation lines are
+	// indented to line up under the first one
+	if prettyPrint {
+		query = strings.ReplaceAll(prettyPrintQuery(query), "\n", "\n         ")
+	}
+
+	output.WriteString(wrapText(fmt.Sprintf("  %sQuery:%s %s%s%s",
 		COLOR_YELLOW, COLOR_DEFAULT,
-		COLOR_WHITE, query, COLOR_DEFAULT))
+		COLOR_WHITE, query, COLOR_DEFAULT), wrapWidth, 9) + "\n")
 
 	// Parse and display response
 	if len(responseData) > 0 {
 		// Check if this might be a complete result set by looking for multiple packets
 		packets := collectAllResponsePackets(responseData)
 
+		// MariaDB progress reports come ahead of the response proper; show
+		// the latest instead of taking them for errors
+		var progress string
+		reports := 0
+		for len(packets) > 1 {
+			p, ok := parseProgressReport(packets[0])
+			if !ok {
+				break
+			}
+			progress = p.String()
+			reports++
+			packets = packets[1:]
+		}
+
+		// Whether the response fit none of the shapes we know, so what we
+		// make of it may well be wrong
 		var result string
-		if len(packets) > 1 && responseData[0] != MYSQL_OK_PACKET && responseData[0] != MYSQL_ERR_PACKET {
+		unrecognized := false
+		if len(packets) == 0 {
+			result = "Incomplete response"
+			unrecognized = true
+		} else if packets[0][0] == MYSQL_LOCAL_INFILE_PACKET {
+			// The file's name, then the server's answer once it was sent
+			result = fmt.Sprintf("%sLOCAL INFILE %s%s", COLOR_CYAN, packets[0][1:], COLOR_DEFAULT)
+			if len(packets) > 1 {
+				result += " -> " + parseResponse(packets[1], showRows)
+			}
+		} else if len(packets) > 1 && packets[0][0] != MYSQL_OK_PACKET && packets[0][0] != MYSQL_ERR_PACKET {
 			// Multiple packets - likely a result set
-			result = parseResultSetFull(packets, showRows)
+			result = parseResultSetFull(packets, capabilities, showRows, charset)
 		} else {
 			// Single packet response
-			result = parseResponse(responseData, showRows)
+			result = parseResponse(packets[0], showRows)
+			switch packets[0][0] {
+			case MYSQL_OK_PACKET, MYSQL_ERR_PACKET, MYSQL_EOF_PACKET:
+			default:
+				// A column count with nothing after it isn't a result set
+				unrecognized = true
+			}
 		}
 
-		output.WriteString(fmt.Sprintf("  %sResult:%s %s\n", COLOR_YELLOW, COLOR_DEFAULT, result))
+		output.WriteString(wrapText(fmt.Sprintf("  %sResult:%s %s", COLOR_YELLOW, COLOR_DEFAULT, result), wrapWidth, 10) + "\n")
+		if reports > 0 {
+			output.WriteString(fmt.Sprintf("  %s (%d report(s))\n", progress, reports))
+		}
+		if unrecognized && hexdumpUnrecognized {
+			output.WriteString(fmt.Sprintf("  %sRaw:%s\n%s", COLOR_YELLOW, COLOR_DEFAULT, boundedHexdump(responseData, maxHexdumpBytes)))
+		}
 	}
 
 	slog.Info(output.String())
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// loadShedder falls back to count-only processing with -shed-load while the
+// capture backlog (packets captured but not yet handled) is over highWater,
+// and goes back to full processing once it has drained to lowWater. Falling
+// behind with full parsing only grows the backlog until the capture drops
+// packets; counting verbs keeps the numbers flowing through a spike.
+type loadShedder struct {
+	highWater int
+	lowWater  int
+
+	degraded bool
+	since    time.Time
+
+	// times we fell back, and the time spent degraded before the current
+	// stretch
+	stretches uint64
+	total     time.Duration
+}
+
+// PACKET_QUEUE_SIZE is how many captured packets gopacket's PacketSource
+// buffers, so the most the backlog can ever reach
+const PACKET_QUEUE_SIZE = 1000
+
+var shedder *loadShedder
+
+func newLoadShedder(highWater int) *loadShedder {
+	return &loadShedder{highWater: highWater, lowWater: highWater / 2}
+}
+
+// update switches modes if the backlog at now has crossed a threshold,
+// reporting whether it did
+func (l *loadShedder) update(backlog int, now time.Time) bool {
+	switch {
+	case !l.degraded && backlog >= l.highWater:
+		l.degraded = true
+		l.since = now
+		l.stretches++
+		return true
+	case l.degraded && backlog <= l.lowWater:
+		l.degraded = false
+		l.total += now.Sub(l.since)
+		return true
+	}
+	return false
+}
+
+// degradedFor is the time spent in count-only processing so far, including
+// the current stretch
+func (l *loadShedder) degradedFor(now time.Time) time.Duration {
+	if l.degraded {
+		return l.total + now.Sub(l.since)
+	}
+	return l.total
+}
+
+// checkBacklog applies -shed-load to the backlog at now. Responses aren't
+// followed while degraded, so on the way back every stream has to resync.
+func checkBacklog(backlog int, now time.Time) {
+	if !shedder.update(backlog, now) {
+		return
+	}
+	if shedder.degraded {
+		log.Printf("%sBacklog of %d packets, counting queries only until it drops to %d%s",
+			COLOR_RED, backlog, shedder.lowWater, COLOR_DEFAULT)
+		return
+	}
+
+	for _, rs := range chmap {
+		if rs.synced {
+			desyncSource(rs)
+		} else {
+			rs.reqBuffer, rs.respBuffer = nil, nil
+		}
+	}
+	log.Printf("%sCaught up after %s, back to full processing%s",
+		COLOR_GREEN, now.Sub(shedder.since).Round(time.Millisecond), COLOR_DEFAULT)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of TCP ports
+type portRange struct {
+	lo, hi uint16
+}
+
+// serverPorts are the ports the MySQL server (or proxy) listens on. Packets to
+// one of them are requests, packets from one are responses.
+var serverPorts []portRange
+
+// lowerPortIsServer decides direction for packets where neither port is a
+// known server port: the lower port is taken to be the server's, since
+// clients use high ephemeral ports.
+var lowerPortIsServer bool = false
+
+// parseServerPorts parses a comma-separated list of ports and port ranges,
+// e.g. "3306,3307-3310".
+func parseServerPorts(spec string) ([]portRange, error) {
+	var ranges []portRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		loStr, hiStr, isRange := strings.Cut(part, "-")
+		lo, err := strconv.ParseUint(loStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.ParseUint(hiStr, 10, 16); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		ranges = append(ranges, portRange{uint16(lo), uint16(hi)})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no ports in %q", spec)
+	}
+	return ranges, nil
+}
+
+// isServerPort reports whether p is one of the configured server ports
+func isServerPort(p uint16) bool {
+	for _, r := range serverPorts {
+		if p >= r.lo && p <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// packetDirection works out whether a packet is a request (client to server)
+// or a response. ok is false if we can't tell.
+func packetDirection(srcPort, dstPort uint16) (request bool, ok bool) {
+	srcServer, dstServer := isServerPort(srcPort), isServerPort(dstPort)
+	switch {
+	case dstServer && !srcServer:
+		return true, true
+	case srcServer && !dstServer:
+		return false, true
+	}
+
+	// Neither (or both) ends are known server ports, e.g. a proxy talking
+	// to a backend on a port we weren't told about.
+	if lowerPortIsServer && srcPort != dstPort {
+		return dstPort < srcPort, true
+	}
+	return false, false
+}
+
+// IP_FRAGMENT_FILTER matches the non-first fragments of TCP datagrams. They
+// carry no TCP header, and port and portrange only match packets with a zero
+// fragment offset, so without it the kernel drops every piece but the first
+// and defragment never completes a datagram.
+const IP_FRAGMENT_FILTER = "(ip proto \\tcp and ip[6:2] & 0x1fff != 0)"
+
+// captureFilter builds the BPF filter matching the server ports, plus the
+// fragments defragment reassembles them from. With the lower-port heuristic
+// any TCP traffic may be MySQL, so we can't filter by port at all; tcp
+// matches the IP protocol, which every fragment carries.
+func captureFilter() string {
+	if lowerPortIsServer {
+		return "tcp"
+	}
+
+	var terms []string
+	for _, r := range serverPorts {
+		if r.lo == r.hi {
+			terms = append(terms, fmt.Sprintf("port %d", r.lo))
+		} else {
+			terms = append(terms, fmt.Sprintf("portrange %d-%d", r.lo, r.hi))
+		}
+	}
+	return "(tcp and (" + strings.Join(terms, " or ") + ")) or " + IP_FRAGMENT_FILTER
+}
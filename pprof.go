@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// startPprof serves the net/http/pprof endpoints on addr in the background and
+// returns the address actually bound (useful when addr asks for port 0).
+func startPprof(addr string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	// Use a private mux rather than http.DefaultServeMux so nothing else can
+	// end up exposed on the profiling port.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("pprof server stopped", "error", err)
+		}
+	}()
+
+	return ln.Addr().String(), nil
+}
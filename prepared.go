@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// NO_REUSE_RATIO is how many executes per prepare a shape needs to count as
+// reusing its statements; below it, the client re-prepares for (nearly)
+// every execute and pays an extra round trip each time
+const NO_REUSE_RATIO = 2
+
+// preparedShape is what -by-prepared has seen of one prepared statement
+// shape, keyed by its canonical SQL
+type preparedShape struct {
+	prepares uint64
+	executes uint64
+
+	// time spent waiting for PREPARE_OK and for execute responses, and how
+	// many executes that covers (an execute still in flight isn't timed yet)
+	prepareTime   uint64
+	executeTime   uint64
+	executesTimed uint64
+}
+
+var byPrepared bool = false
+var preparedShapes map[string]*preparedShape = make(map[string]*preparedShape)
+
+// preparedShapeFor returns the stats for a canonical statement, creating them
+func preparedShapeFor(query string) *preparedShape {
+	shape, ok := preparedShapes[query]
+	if !ok {
+		shape = &preparedShape{}
+		preparedShapes[query] = shape
+	}
+	return shape
+}
+
+// noReuse reports whether a shape is prepared about as often as it's
+// executed. A single prepare proves nothing either way.
+func (p *preparedShape) noReuse() bool {
+	return p.prepares > 1 && p.executes < NO_REUSE_RATIO*p.prepares
+}
+
+// avgMs is the average of total nanoseconds over n, in milliseconds
+func avgMs(total, n uint64) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(total) / float64(n) / float64(time.Millisecond)
+}
+
+// reportPreparedShapes prints prepares and executes per statement shape and
+// the average latency of each, most prepared first, calling out the shapes
+// that don't reuse their statements
+func reportPreparedShapes() {
+	queries := make([]string, 0, len(preparedShapes))
+	flagged := 0
+	for query, shape := range preparedShapes {
+		queries = append(queries, query)
+		if shape.noReuse() {
+			flagged++
+		}
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		a, b := preparedShapes[queries[i]], preparedShapes[queries[j]]
+		if a.prepares != b.prepares {
+			return a.prepares > b.prepares
+		}
+		return queries[i] < queries[j]
+	})
+
+	if flagged > 0 {
+		log.Printf("%s%d prepared statement shape(s) re-prepared for nearly every execute%s", COLOR_YELLOW, flagged, COLOR_DEFAULT)
+	}
+	log.Printf("Prepared statements (prepares, executes, executes per prepare, avg prepare ms, avg execute ms):")
+	for _, query := range queries {
+		shape := preparedShapes[query]
+		ratio := 0.0
+		if shape.prepares > 0 {
+			ratio = float64(shape.executes) / float64(shape.prepares)
+		}
+		note := ""
+		if shape.noReuse() {
+			note = COLOR_YELLOW + " [no reuse]" + COLOR_DEFAULT
+		}
+		log.Printf("%8d %8d %8.1f %10.3f %10.3f  %s%s", shape.prepares, shape.executes, ratio,
+			avgMs(shape.prepareTime, shape.prepares), avgMs(shape.executeTime, shape.executesTimed), escapeControlBytes(query), note)
+	}
+}
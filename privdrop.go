@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// lookupUserIDs resolves a user name, or a numeric uid, to the uid and
+// primary gid to run as
+func lookupUserIDs(name string) (uid, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		var idErr error
+		if u, idErr = user.LookupId(name); idErr != nil {
+			return 0, 0, err
+		}
+	}
+
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %s has non-numeric uid %q", name, u.Uid)
+	}
+	gid, err = strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %s has non-numeric gid %q", name, u.Gid)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "log"
+
+// dropPrivileges is unix-only; -user can't be honored here, and carrying on
+// as the capturing user isn't what was asked for
+func dropPrivileges(name string) error {
+	log.Fatalf("-user is not supported on this platform")
+	return nil
+}
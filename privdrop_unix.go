@@ -0,0 +1,35 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the given user once the capture is
+// open, so nothing after that runs as root. The group goes first, since
+// changing it needs the privileges we're giving up.
+func dropPrivileges(name string) error {
+	uid, gid, err := lookupUserIDs(name)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid(%d): %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid(%d): %w", uid, err)
+	}
+
+	// Make sure it stuck; carrying on as root would be worse than stopping
+	if os.Getuid() != uid || os.Geteuid() != uid || os.Getgid() != gid {
+		return fmt.Errorf("still running as uid %d gid %d", os.Geteuid(), os.Getegid())
+	}
+	return nil
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// queryTokens splits a query into its tokens and their types using lexToken,
+// so -n doesn't blind the checks built on it
+func queryTokens(query []byte) ([]string, []int) {
+	var tokens []string
+	var types []int
+	for i := 0; i < len(query); {
+		length, toktype := lexToken(query[i:], sqlMode{})
+		tokens = append(tokens, string(query[i:i+length]))
+		types = append(types, toktype)
+		i += length
+	}
+	return tokens, types
+}
+
+// isCartesianJoin reports whether a query joins tables without any join
+// condition: a comma join or a JOIN lacking ON/USING in the outermost FROM
+// clause, with no WHERE clause that could hold the predicate. Explicit CROSS
+// JOINs and NATURAL JOINs are taken to be intentional. This works on the raw
+// query, since canonicalization drops the commas between table names.
+func isCartesianJoin(query []byte) bool {
+	tokens, types := queryTokens(query)
+
+	depth := 0
+	inFrom, seenFrom, hasWhere := false, false, false
+	unconditioned, pendingJoin := false, false
+	prevWord := ""
+
+	// endFrom closes the FROM clause; a JOIN still waiting for its ON/USING
+	// at that point never got one.
+	endFrom := func() {
+		if inFrom && pendingJoin {
+			unconditioned = true
+		}
+		inFrom, pendingJoin = false, false
+	}
+
+	for i, tok := range tokens {
+		if types[i] == TOKEN_OTHER {
+			switch tok {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			case ",":
+				if inFrom && depth == 0 {
+					unconditioned = true
+				}
+			}
+			continue
+		}
+		if types[i] != TOKEN_WORD || depth != 0 {
+			continue
+		}
+
+		word := strings.ToUpper(tok)
+		switch word {
+		case "FROM":
+			if !seenFrom {
+				inFrom, seenFrom = true, true
+			}
+		case "JOIN", "STRAIGHT_JOIN":
+			if inFrom {
+				if pendingJoin {
+					unconditioned = true
+				}
+				pendingJoin = prevWord != "CROSS" && prevWord != "NATURAL"
+			}
+		case "ON", "USING":
+			pendingJoin = false
+		case "WHERE":
+			hasWhere = true
+			endFrom()
+		case "GROUP", "ORDER", "LIMIT", "HAVING", "UNION", "FOR", "LOCK", "WINDOW":
+			endFrom()
+		}
+		prevWord = word
+	}
+	endFrom()
+
+	return unconditioned && !hasWhere
+}
+
+// isLoadDataLocal reports whether a query is LOAD DATA LOCAL (or LOAD XML
+// LOCAL), which has the client send a file from its own filesystem.
+func isLoadDataLocal(query []byte) bool {
+	tokens, types := queryTokens(query)
+
+	var words []string
+	for i, tok := range tokens {
+		if types[i] == TOKEN_WHITESPACE {
+			continue
+		}
+		words = append(words, strings.ToUpper(tok))
+		if len(words) == 4 {
+			break
+		}
+	}
+
+	if len(words) < 3 || words[0] != "LOAD" || (words[1] != "DATA" && words[1] != "XML") {
+		return false
+	}
+	if words[2] == "LOW_PRIORITY" || words[2] == "CONCURRENT" {
+		return len(words) == 4 && words[3] == "LOCAL"
+	}
+	return words[2] == "LOCAL"
+}
+
+// proxyHintKeys are the ProxySQL comment annotations, e.g.
+// /* ;hostgroup=2;max_lag_ms=500 */
+var proxyHintKeys = map[string]bool{
+	"hostgroup":             true,
+	"max_lag_ms":            true,
+	"min_epoch_ms":          true,
+	"min_gtid":              true,
+	"create_new_connection": true,
+	"query_delay":           true,
+	"query_timeout":         true,
+	"multiplex":             true,
+}
+
+// isProxyHint reports whether the text of a comment is a proxy routing hint:
+// ProxySQL key=value annotations (optionally /*+ ... */ and ;-separated), or a
+// MaxScale hint ("maxscale route to master" and the like)
+func isProxyHint(comment string) bool {
+	comment = strings.TrimSpace(strings.TrimPrefix(comment, "+"))
+	if strings.HasPrefix(strings.ToLower(comment), "maxscale ") {
+		return true
+	}
+
+	found := false
+	for _, part := range strings.Split(comment, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, _, ok := strings.Cut(part, "=")
+		if !ok || !proxyHintKeys[strings.ToLower(strings.TrimSpace(key))] {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// stripProxyHints removes the routing hints a ProxySQL or MaxScale deployment
+// adds to queries, so hinted and direct queries canonicalize the same. Other
+// comments are left alone, as are hints inside string literals.
+func stripProxyHints(query []byte, mode sqlMode) []byte {
+	var out []byte
+	stripped := false
+	last := 0
+	for i := 0; i < len(query); {
+		switch {
+		case bytes.HasPrefix(query[i:], []byte("/*")):
+			end := bytes.Index(query[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(query)
+				continue
+			}
+			next := i + 2 + end + 2
+			if isProxyHint(string(query[i+2 : i+2+end])) {
+				out = append(out, query[last:i]...)
+				last, stripped = next, true
+			}
+			i = next
+
+		case bytes.HasPrefix(query[i:], []byte("-- ")) || query[i] == '#':
+			end := bytes.IndexByte(query[i:], '\n')
+			next := len(query)
+			if end >= 0 {
+				next = i + end
+			}
+			text := strings.TrimPrefix(strings.TrimPrefix(string(query[i:next]), "#"), "--")
+			if isProxyHint(text) {
+				out = append(out, query[last:i]...)
+				last, stripped = next, true
+			}
+			i = next
+
+		default:
+			length, _ := scanTokenWithMode(query[i:], mode)
+			i += length
+		}
+	}
+
+	if !stripped {
+		return query
+	}
+	out = append(out, query[last:]...)
+	return bytes.TrimSpace(out)
+}
+
+// isLockingRead reports whether a query is a locking read: a SELECT ending in
+// FOR UPDATE, FOR SHARE or LOCK IN SHARE MODE at the outermost level (a
+// locking subquery inside, say, an INSERT ... SELECT doesn't count).
+func isLockingRead(query []byte) bool {
+	switch queryVerb(query) {
+	case "SELECT", "WITH":
+	default:
+		return false
+	}
+
+	tokens, types := queryTokens(query)
+	var words []string
+	depth := 0
+	for i, tok := range tokens {
+		switch {
+		case tok == "(":
+			depth++
+		case tok == ")":
+			depth--
+		case depth == 0 && types[i] == TOKEN_WORD:
+			words = append(words, strings.ToUpper(tok))
+		}
+	}
+
+	for i := range words {
+		switch {
+		case i+1 < len(words) && words[i] == "FOR" && (words[i+1] == "UPDATE" || words[i+1] == "SHARE"):
+			return true
+		case i+3 < len(words) && words[i] == "LOCK" && words[i+1] == "IN" && words[i+2] == "SHARE" && words[i+3] == "MODE":
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminQuery reports whether a query is an administrative statement rather
+// than part of the application's workload
+func isAdminQuery(query []byte) bool {
+	switch queryVerb(query) {
+	case "KILL", "SHOW", "SET", "FLUSH", "GRANT", "REVOKE", "RESET", "PURGE",
+		"INSTALL", "UNINSTALL", "SHUTDOWN", "RESTART":
+		return true
+	default:
+		return false
+	}
+}
+
+// callProcedureName returns the procedure a CALL statement invokes, lowercased
+// and with any backquotes removed, e.g. "shop.place_order" for
+// CALL `Shop`.`place_order`(1, 2). Returns "" for anything that isn't a CALL.
+func callProcedureName(query []byte) string {
+	if queryVerb(query) != "CALL" {
+		return ""
+	}
+
+	_, i := verbBounds(query)
+	for i < len(query) && (query[i] == 32 || (query[i] >= 9 && query[i] <= 13)) {
+		i++
+	}
+
+	var name []byte
+	quoted := false
+	for ; i < len(query); i++ {
+		b := query[i]
+		if b == '`' {
+			quoted = !quoted
+			continue
+		}
+		if !quoted && (b == '(' || b == ';' || b == 32 || (b >= 9 && b <= 13)) {
+			break
+		}
+		name = append(name, b)
+	}
+	return strings.ToLower(string(name))
+}
+
+// splitStatements splits a multi-statement COM_QUERY on the semicolons
+// between statements, leaving those inside quoted strings alone. Empty
+// statements, such as after a trailing semicolon, are dropped.
+func splitStatements(query []byte, mode sqlMode) [][]byte {
+	var statements [][]byte
+	last := 0
+	add := func(stmt []byte) {
+		if stmt = bytes.TrimSpace(stmt); len(stmt) > 0 {
+			statements = append(statements, stmt)
+		}
+	}
+	for i := 0; i < len(query); {
+		length, _ := lexToken(query[i:], mode)
+		if length == 1 && query[i] == ';' {
+			add(query[last:i])
+			last = i + 1
+		}
+		i += length
+	}
+	add(query[last:])
+	return statements
+}
+
+// duplicateStatements returns the canonical statements that appear more than
+// once in a multi-statement query, with how many times each appears
+func duplicateStatements(query []byte, mode sqlMode) map[string]int {
+	statements := splitStatements(query, mode)
+	if len(statements) < 2 {
+		return nil
+	}
+
+	seen := make(map[string]int)
+	for _, stmt := range statements {
+		seen[cleanupQueryWithMode(stmt, mode)]++
+	}
+	var dups map[string]int
+	for canonical, n := range seen {
+		if n > 1 {
+			if dups == nil {
+				dups = make(map[string]int)
+			}
+			dups[canonical] = n
+		}
+	}
+	return dups
+}
+
+// isUnboundedWrite reports whether a query is an UPDATE or DELETE with no
+// WHERE clause, which touches every row of the table. A LIMIT (batched
+// purges) or a JOIN (the join condition picks the rows) is taken as bounding
+// it; only the outermost level counts, so a WHERE in a subquery doesn't.
+func isUnboundedWrite(query []byte) bool {
+	switch queryVerb(query) {
+	case "UPDATE", "DELETE":
+	default:
+		return false
+	}
+
+	tokens, types := queryTokens(query)
+	depth := 0
+	for i, tok := range tokens {
+		switch {
+		case tok == "(":
+			depth++
+		case tok == ")":
+			depth--
+		case depth == 0 && types[i] == TOKEN_WORD:
+			switch strings.ToUpper(tok) {
+			case "WHERE", "LIMIT", "JOIN":
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// timeWastingFunctions are server functions whose only effect is to burn
+// time. In production traffic they usually mean a SQL injection probe
+// (timing-based blind injection) or debugging left in.
+var timeWastingFunctions = map[string]bool{
+	"SLEEP":     true,
+	"BENCHMARK": true,
+}
+
+// timeWastingCall returns the first time-wasting function a query calls, or
+// "" if it calls none. Only a name followed by an opening parenthesis is a
+// call, so a column that happens to be named sleep doesn't count.
+func timeWastingCall(query []byte) string {
+	tokens, types := queryTokens(query)
+	for i, tok := range tokens {
+		if types[i] != TOKEN_WORD || !timeWastingFunctions[strings.ToUpper(tok)] {
+			continue
+		}
+		next := i + 1
+		for next < len(tokens) && types[next] == TOKEN_WHITESPACE {
+			next++
+		}
+		if next < len(tokens) && tokens[next] == "(" {
+			return strings.ToUpper(tok)
+		}
+	}
+	return ""
+}
+
+// Statement classes for the read/write ratio
+const (
+	CLASS_OTHER = iota
+	CLASS_READ
+	CLASS_WRITE
+	CLASS_DDL
+)
+
+// queryClass sorts a query into reads, writes and DDL by its leading keyword
+func queryClass(query []byte) int {
+	switch queryVerb(query) {
+	case "SELECT", "SHOW", "DESCRIBE", "DESC", "EXPLAIN", "WITH":
+		return CLASS_READ
+	case "INSERT", "UPDATE", "DELETE", "REPLACE", "LOAD":
+		return CLASS_WRITE
+	case "CREATE", "ALTER", "DROP", "TRUNCATE", "RENAME":
+		return CLASS_DDL
+	default:
+		return CLASS_OTHER
+	}
+}
+
+// readWriteRatio is reads per write, formatted for the status update
+func readWriteRatio(reads, writes uint64) string {
+	if writes == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f", float64(reads)/float64(writes))
+}
+
+// whereClauseEnd are the keywords that end a WHERE clause
+var whereClauseEnd = map[string]bool{
+	"GROUP": true, "ORDER": true, "LIMIT": true, "HAVING": true, "WINDOW": true,
+	"FOR": true, "LOCK": true, "UNION": true, "INTO": true, "ON": true, "RETURNING": true,
+}
+
+// whereColumns returns the columns the outermost WHERE clause of a query
+// filters on, lowercased, without table qualifiers, sorted and deduplicated:
+// every column compared against a value (a literal or a ? placeholder) with
+// =, <, LIKE, IN, BETWEEN, IS NULL and so on. Comparisons between columns are
+// join conditions rather than filters and subqueries filter other tables, so
+// neither counts.
+func whereColumns(query []byte) []string {
+	all, allTypes := queryTokens(query)
+	var tokens []string
+	var types []int
+	for i, tok := range all {
+		if allTypes[i] != TOKEN_WHITESPACE {
+			tokens = append(tokens, tok)
+			types = append(types, allTypes[i])
+		}
+	}
+	upper := func(i int) string {
+		if i < len(tokens) && types[i] == TOKEN_WORD {
+			return strings.ToUpper(tokens[i])
+		}
+		return ""
+	}
+
+	// Find the outermost WHERE
+	start, depth := -1, 0
+	for i, tok := range tokens {
+		switch {
+		case tok == "(":
+			depth++
+		case tok == ")":
+			depth--
+		case depth == 0 && upper(i) == "WHERE":
+			start = i + 1
+		}
+		if start >= 0 {
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+
+	// isValue reports whether a value, or a list of them, starts at i
+	isValue := func(i int) bool {
+		if i < len(tokens) && tokens[i] == "(" {
+			i++
+		}
+		if i < len(tokens) && (tokens[i] == "-" || tokens[i] == "+") {
+			i++
+		}
+		switch {
+		case i >= len(tokens):
+			return false
+		case tokens[i] == "?", types[i] == TOKEN_QUOTE, types[i] == TOKEN_NUMBER:
+			return true
+		}
+		switch upper(i) {
+		case "NULL", "TRUE", "FALSE":
+			return true
+		}
+		return false
+	}
+
+	// comparison returns where the value (or IN list) compared against
+	// starts, if an operator starts at i
+	comparison := func(i int) (int, bool) {
+		if upper(i) == "NOT" {
+			i++
+		}
+		switch upper(i) {
+		case "LIKE", "BETWEEN", "REGEXP", "RLIKE":
+			return i + 1, true
+		case "IN":
+			return i + 1, i+1 < len(tokens) && tokens[i+1] == "("
+
+		case "IS":
+			if upper(i+1) == "NOT" {
+				return i + 2, true
+			}
+			return i + 1, true
+		}
+		op := ""
+		for i < len(tokens) && len(tokens[i]) == 1 && strings.Contains("<=>!", tokens[i]) {
+			op += tokens[i]
+			i++
+		}
+		switch op {
+		case "=", "<", ">", "<=", ">=", "!=", "<>", "<=>":
+			return i, true
+		}
+		return i, false
+	}
+
+	seen := make(map[string]bool)
+	depth = 0
+	for i := start; i < len(tokens); i++ {
+		tok := tokens[i]
+		switch {
+		case tok == "(" && upper(i+1) == "SELECT":
+			// Skip the subquery
+			for nested := 0; i < len(tokens); i++ {
+				if tokens[i] == "(" {
+					nested++
+				} else if tokens[i] == ")" {
+					if nested--; nested == 0 {
+						break
+					}
+				}
+			}
+			continue
+		case tok == "(":
+			depth++
+			continue
+		case tok == ")":
+			if depth--; depth < 0 {
+				i = len(tokens)
+			}
+			continue
+		case tok == ";" || (depth == 0 && whereClauseEnd[upper(i)]):
+			i = len(tokens)
+			continue
+		}
+
+		// A column: name, table.name or `name`, not a function call
+		next := i
+		if tok == "`" && next+2 < len(tokens) && tokens[next+2] == "`" {
+			next++
+		}
+		if types[next] != TOKEN_WORD {
+			continue
+		}
+		name := tokens[next]
+		next++
+		if next < len(tokens) && tokens[next] == "`" {
+			next++
+		}
+		for next+1 < len(tokens) && tokens[next] == "." {
+			next++
+			if tokens[next] == "`" && next+2 < len(tokens) {
+				next++
+			}
+			name = tokens[next]
+			next++
+			if next < len(tokens) && tokens[next] == "`" {
+				next++
+			}
+		}
+		if next < len(tokens) && tokens[next] == "(" {
+			continue
+		}
+
+		// Carry on from the value, so the operator isn't taken for a column
+		if valueAt, ok := comparison(next); ok && isValue(valueAt) {
+			seen[strings.ToLower(name)] = true
+			i = valueAt - 1
+		}
+	}
+
+	columns := make([]string, 0, len(seen))
+	for column := range seen {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// whereSignature is the filter-column set of a query for -by-where-columns,
+// e.g. "{status, user_id}", or "" for a query without one
+func whereSignature(query []byte) string {
+	columns := whereColumns(query)
+	if len(columns) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(columns, ", ") + "}"
+}
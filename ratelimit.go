@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// rateLimiter is a token bucket allowing rate events per second on average,
+// in bursts of up to a second's worth
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	// events turned away since the count was last reset
+	suppressed uint64
+}
+
+// verboseLimit caps query displays with -verbose-rate
+var verboseLimit *rateLimiter
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate}
+}
+
+// allow reports whether an event at now fits in the rate, counting it as
+// suppressed if not. Time comes from the caller so capture files are limited
+// by their own timestamps.
+func (l *rateLimiter) allow(now time.Time) bool {
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+
+	if l.tokens < 1 {
+		l.suppressed++
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-mysql-org/go-mysql/client"
+)
+
+// queryExecutor runs a query against the replay target
+type queryExecutor interface {
+	Execute(query string) error
+}
+
+// mysqlExecutor executes replayed queries over a go-mysql client connection
+type mysqlExecutor struct {
+	conn *client.Conn
+}
+
+func (e *mysqlExecutor) Execute(query string) error {
+	result, err := e.conn.Execute(query)
+	if err != nil {
+		return err
+	}
+	result.Close()
+	return nil
+}
+
+// replayer re-sends captured COM_QUERY text to another server. Queries are
+// handed to a single worker through a bounded queue so a slow target never
+// stalls capture; when the queue is full the query is dropped.
+type replayer struct {
+	exec     queryExecutor
+	readOnly bool
+	scale    float64
+	credit   float64
+	queue    chan string
+	done     chan struct{}
+
+	replayed atomic.Uint64
+	skipped  atomic.Uint64
+	dropped  atomic.Uint64
+	failed   atomic.Uint64
+}
+
+var replay *replayer
+
+// newReplayer creates a replayer that replays the given fraction (scale) of
+// observed queries through exec.
+func newReplayer(exec queryExecutor, readOnly bool, scale float64) *replayer {
+	return &replayer{
+		exec:     exec,
+		readOnly: readOnly,
+		scale:    scale,
+		queue:    make(chan string, 1024),
+		done:     make(chan struct{}),
+	}
+}
+
+// offer queues a query for replay, unless the read-only guard or the
+// replay scale says to skip it.
+func (r *replayer) offer(query string) {
+	if r.readOnly && !isReadOnlyQuery([]byte(query)) {
+		r.skipped.Add(1)
+		return
+	}
+
+	// Spread the replayed fraction evenly: each query earns scale credit
+	// and we replay whenever a whole credit has built up.
+	r.credit += r.scale
+	if r.credit < 1 {
+		return
+	}
+	r.credit--
+
+	select {
+	case r.queue <- query:
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+// run executes queued queries until the queue is closed
+func (r *replayer) run() {
+	defer close(r.done)
+	for query := range r.queue {
+		if err := r.exec.Execute(query); err != nil {
+			r.failed.Add(1)
+			slog.Debug("replayed query failed", "error", err, "query", query)
+			continue
+		}
+		r.replayed.Add(1)
+	}
+}
+
+// stop replays whatever is still queued, as at the end of a capture file
+func (r *replayer) stop() {
+	close(r.queue)
+	<-r.done
+}
+
+// isReadOnlyQuery reports whether a query only reads data. It allows a fixed
+// set of verbs rather than rejecting known writes, so anything unfamiliar is
+// treated as a write. Some reads still have side effects on the target and
+// are refused too: SELECT ... INTO OUTFILE (or any INTO) writes files or
+// variables, a locking read takes row locks, and EXPLAIN ANALYZE runs the
+// statement it explains. Words inside string literals don't count, but
+// subqueries do, since a locking subquery locks just the same.
+func isReadOnlyQuery(query []byte) bool {
+	switch queryVerb(query) {
+	case "SELECT", "SHOW", "DESCRIBE", "DESC", "EXPLAIN":
+	default:
+		return false
+	}
+
+	tokens, types := queryTokens(query)
+	var words []string
+	for i, tok := range tokens {
+		if types[i] == TOKEN_WORD {
+			words = append(words, strings.ToUpper(tok))
+		}
+	}
+
+	for i, word := range words {
+		switch {
+		case word == "INTO":
+			return false
+		case i+1 < len(words) && word == "FOR" && (words[i+1] == "UPDATE" || words[i+1] == "SHARE"):
+			return false
+		case i+3 < len(words) && word == "LOCK" && words[i+1] == "IN" && words[i+2] == "SHARE" && words[i+3] == "MODE":
+			return false
+		}
+	}
+
+	// EXPLAIN ANALYZE [FORMAT = TREE] runs what follows; only a SELECT is safe
+	if len(words) > 1 && words[0] == "EXPLAIN" && words[1] == "ANALYZE" {
+		rest := words[2:]
+		if len(rest) >= 2 && rest[0] == "FORMAT" {
+			rest = rest[2:]
+		}
+		return len(rest) > 0 && rest[0] == "SELECT"
+	}
+	return true
+}
+
+// parseReplayDSN splits a DSN of the form user:password@host:port/dbname.
+// The password and database name are optional.
+func parseReplayDSN(dsn string) (addr, user, password, dbName string, err error) {
+	at := strings.LastIndex(dsn, "@")
+	if at < 0 {
+		return "", "", "", "", fmt.Errorf("replay DSN %q is missing user@", dsn)
+	}
+
+	user, password, _ = strings.Cut(dsn[:at], ":")
+	addr, dbName, _ = strings.Cut(dsn[at+1:], "/")
+	if user == "" || addr == "" {
+		return "", "", "", "", fmt.Errorf("replay DSN %q needs both a user and an address", dsn)
+	}
+	return addr, user, password, dbName, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+)
+
+// responseState is where we are in the server's response to a command
+type responseState int
+
+const (
+	respExpecting   responseState = iota // waiting for the first packet of a response
+	respInResultSet                      // reading a result set's column definitions and rows
+	respLocalInfile                      // the server asked for a file and the client is sending it
+	respMoreResults                      // a result ended with SERVER_MORE_RESULTS_EXISTS; another follows
+	respPrepareDefs                      // reading the parameter and column definitions after a PREPARE_OK
+	respDone                             // the whole response has arrived
+)
+
+// responseMachine follows a response packet by packet. A response is an OK,
+// an ERROR, or a result set, any of which may announce that more results
+// follow (multi-statements, stored procedures). A LOCAL INFILE request hands
+// the turn to the client, which sends the file and an empty packet, after
+// which the server answers as for any other command. COM_STMT_PREPARE is
+// answered differently: a PREPARE_OK followed by the statement's parameter
+// and column definitions.
+type responseMachine struct {
+	state responseState
+
+	// the command was COM_STMT_PREPARE, and after its PREPARE_OK, the
+	// definitions (and EOFs) still to come
+	prepare     bool
+	prepareLeft int
+
+	// within a result set: column definitions still to come, and whether
+	// we've reached the rows
+	columnsLeft uint64
+	inRows      bool
+
+	// how much of the response buffer has been fed through already
+	offset int
+}
+
+// feed advances the machine over every complete packet in buffer it hasn't
+// seen yet and reports whether the whole response has arrived. buffer is the
+// response so far; trailing bytes of a partial packet wait for the next call.
+func (m *responseMachine) feed(buffer []byte, capabilities uint32) bool {
+	for m.state != respDone && m.state != respLocalInfile && len(buffer)-m.offset >= 4 {
+		header := buffer[m.offset:]
+		size := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+		if len(header) < size+4 {
+			break
+		}
+		m.serverPacket(header[4:size+4], capabilities)
+		m.offset += size + 4
+	}
+	return m.state == respDone
+}
+
+// serverPacket advances the machine on one packet payload from the server
+func (m *responseMachine) serverPacket(pkt []byte, capabilities uint32) {
+	if len(pkt) == 0 {
+		return
+	}
+
+	switch m.state {
+	case respExpecting, respMoreResults, respLocalInfile:
+		if m.prepare && pkt[0] == MYSQL_OK_PACKET {
+			m.prepareLeft = prepareDefinitions(pkt, capabilities)
+			m.state = respPrepareDefs
+			if m.prepareLeft == 0 {
+				m.state = respDone
+			}
+			return
+		}
+		switch pkt[0] {
+		case MYSQL_OK_PACKET:
+			m.endResult(okStatusFlags(pkt))
+		case MYSQL_EOF_PACKET:
+			m.endResult(eofStatusFlags(pkt))
+		case MYSQL_ERR_PACKET:
+			if _, ok := parseProgressReport(pkt); ok {
+				// Only progress so far; the response is still to come
+				return
+			}
+			m.state = respDone
+		case MYSQL_LOCAL_INFILE_PACKET:
+			m.state = respLocalInfile
+		default:
+			count, metadata, ok := parseColumnCount(pkt, capabilities)
+			if !ok {
+				// Not something we can follow; take it as the whole response
+				m.state = respDone
+				return
+			}
+			m.state = respInResultSet
+			m.columnsLeft, m.inRows = 0, false
+			if metadata {
+				m.columnsLeft = count
+			}
+		}
+
+	case respPrepareDefs:
+		if m.prepareLeft--; m.prepareLeft == 0 {
+			m.state = respDone
+		}
+
+	case respInResultSet:
+		if m.columnsLeft > 0 {
+			m.columnsLeft--
+			return
+		}
+		if !m.inRows {
+			m.inRows = true
+			// The EOF after the column definitions, when CLIENT_DEPRECATE_EOF
+			// isn't set, is always exactly 5 bytes, while an OK packet standing
+			// in for the final EOF is at least 7.
+			if isEOFPacket(pkt) && len(pkt) == 5 {
+				return
+			}
+		}
+		switch {
+		case isEOFPacket(pkt):
+			m.endResult(eofStatusFlags(pkt))
+		case pkt[0] == MYSQL_ERR_PACKET:
+			m.state = respDone
+		}
+	}
+}
+
+// prepareDefinitions is how many packets follow a PREPARE_OK: status (0x00),
+// statement ID (4), column count (2), parameter count (2), filler (1),
+// warning count (2), then with CLIENT_OPTIONAL_RESULTSET_METADATA whether
+// definitions are sent at all. Each group of definitions ends with an EOF
+// unless CLIENT_DEPRECATE_EOF is set.
+func prepareDefinitions(pkt []byte, capabilities uint32) int {
+	if len(pkt) < 12 {
+		return 0
+	}
+	if capabilities&mysql.CLIENT_OPTIONAL_RESULTSET_METADATA != 0 && len(pkt) > 12 && pkt[12] == RESULTSET_METADATA_NONE {
+		return 0
+	}
+
+	total := 0
+	for _, n := range []uint16{binary.LittleEndian.Uint16(pkt[7:9]), binary.LittleEndian.Uint16(pkt[5:7])} {
+		if n == 0 {
+			continue
+		}
+		total += int(n)
+		if capabilities&mysql.CLIENT_DEPRECATE_EOF == 0 {
+			total++
+		}
+	}
+	return total
+}
+
+// preparedStatementID reads the statement ID from a response that starts
+// with a PREPARE_OK
+func preparedStatementID(response []byte) (uint32, bool) {
+	packets := collectAllResponsePackets(response)
+	if len(packets) == 0 || len(packets[0]) < 5 || packets[0][0] != MYSQL_OK_PACKET {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(packets[0][1:5]), true
+}
+
+// clientDone notes that the client finished sending a LOCAL INFILE file,
+// after which the server sends its OK or ERROR
+func (m *responseMachine) clientDone() {
+	if m.state == respLocalInfile {
+		m.state = respExpecting
+	}
+}
+
+// endResult finishes one result, moving on to the next if the server said
+// there's another
+func (m *responseMachine) endResult(statusFlags uint16) {
+	if statusFlags&mysql.SERVER_MORE_RESULTS_EXISTS != 0 {
+		m.state = respMoreResults
+		return
+	}
+	m.state = respDone
+}
+
+// okStatusFlags reads the status flags of an OK packet (or of an OK packet
+// with the 0xfe header standing in for an EOF): header, affected rows and
+// last insert ID, then the flags
+func okStatusFlags(pkt []byte) uint16 {
+	pos := 1
+	for i := 0; i < 2; i++ {
+		_, _, n := mysql.LengthEncodedInt(pkt[pos:])
+		if n == 0 {
+			return 0
+		}
+		pos += n
+	}
+	if len(pkt) < pos+2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(pkt[pos : pos+2])
+}
+
+// eofStatusFlags reads the status flags of an EOF, which is either a real
+// 5-byte EOF packet or, with CLIENT_DEPRECATE_EOF, an OK packet
+func eofStatusFlags(pkt []byte) uint16 {
+	if eof, ok := parseEOFPacket(pkt); ok && len(pkt) == 5 {
+		return eof.statusFlags
+	}
+	return okStatusFlags(pkt)
+}
+
+// consumeLocalInfile reads the file a client sends after a LOCAL INFILE
+// request: packets of file data ending with an empty one. Returns whatever
+// follows the empty packet, which is a command again.
+func consumeLocalInfile(rs *source, data []byte) []byte {
+	rs.reqBuffer = append(rs.reqBuffer, data...)
+	for len(rs.reqBuffer) >= 4 {
+		size := int(uint32(rs.reqBuffer[0]) | uint32(rs.reqBuffer[1])<<8 | uint32(rs.reqBuffer[2])<<16)
+		if len(rs.reqBuffer) < size+4 {
+			break
+		}
+		rs.reqBuffer = rs.reqBuffer[size+4:]
+		if size == 0 {
+			rs.response.clientDone()
+			rest := rs.reqBuffer
+			rs.reqBuffer = nil
+			return rest
+		}
+	}
+	if len(rs.reqBuffer) == 0 {
+		rs.reqBuffer = nil
+	}
+	return nil
+}
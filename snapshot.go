@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var snapshotDir string
+var snapshotKeep int = 0
+
+// reportStatus prints the status report and, with -snapshot-dir, also saves
+// it to a file of its own named for when it was taken
+func reportStatus(now time.Time) {
+	if snapshotDir == "" {
+		handleStatusUpdate()
+		return
+	}
+
+	path := filepath.Join(snapshotDir, "snapshot-"+now.Format("20060102-150405.000")+".txt")
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Failed to write snapshot: %s", err.Error())
+		handleStatusUpdate()
+		return
+	}
+
+	out := log.Writer()
+	log.SetOutput(io.MultiWriter(out, f))
+	handleStatusUpdate()
+	log.SetOutput(out)
+
+	if err := f.Close(); err != nil {
+		log.Printf("Failed to write snapshot: %s", err.Error())
+	}
+	if err := pruneSnapshots(snapshotDir, snapshotKeep); err != nil {
+		log.Printf("Failed to prune snapshots: %s", err.Error())
+	}
+}
+
+// pruneSnapshots removes all but the keep most recent snapshots in dir; keep
+// 0 leaves them all. The timestamps in the names sort oldest first.
+func pruneSnapshots(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "snapshot-*.txt"))
+	if err != nil {
+		return err
+	}
+	if len(names) <= keep {
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import "strings"
+
+// sqlMode holds the session SQL mode flags that change how queries tokenize
+type sqlMode struct {
+	ansiQuotes         bool
+	noBackslashEscapes bool
+}
+
+// parseSQLMode interprets a sql_mode value such as
+// 'STRICT_TRANS_TABLES,ANSI_QUOTES'. Combination modes that imply ANSI_QUOTES
+// (ANSI, and the pre-8.0 DB2/MAXDB/MSSQL/ORACLE/POSTGRESQL) count too.
+func parseSQLMode(value string) sqlMode {
+	var mode sqlMode
+	for _, flag := range strings.Split(value, ",") {
+		switch strings.ToUpper(strings.TrimSpace(flag)) {
+		case "ANSI_QUOTES", "ANSI", "DB2", "MAXDB", "MSSQL", "ORACLE", "POSTGRESQL":
+			mode.ansiQuotes = true
+		case "NO_BACKSLASH_ESCAPES":
+			mode.noBackslashEscapes = true
+		}
+	}
+	return mode
+}
+
+// parseSQLModeSet recognizes a statement setting the session sql_mode, e.g.
+// SET sql_mode = '...', SET SESSION sql_mode = '...' or
+// SET @@session.sql_mode = '...', possibly among other assignments, and
+// returns the resulting mode. Only string literals and DEFAULT are
+// understood; an expression like CONCAT(@@sql_mode, ...) leaves the mode
+// unknown, so ok is false.
+func parseSQLModeSet(query []byte, current sqlMode) (mode sqlMode, ok bool) {
+	// Collect the significant tokens; whitespace doesn't matter here
+	var tokens []string
+	var types []int
+	for i := 0; i < len(query); {
+		length, toktype := lexToken(query[i:], current)
+		if toktype != TOKEN_WHITESPACE {
+			tokens = append(tokens, string(query[i:i+length]))
+			types = append(types, toktype)
+		}
+		i += length
+	}
+	if len(tokens) == 0 || strings.ToUpper(tokens[0]) != "SET" {
+		return current, false
+	}
+
+	// Walk the comma-separated assignments: target = value
+	pos := 1
+	for pos < len(tokens) {
+		target := ""
+		for pos < len(tokens) && tokens[pos] != "=" && tokens[pos] != "," {
+			if tokens[pos] != ":" {
+				target += strings.ToLower(tokens[pos])
+			}
+			pos++
+		}
+		if pos < len(tokens) && tokens[pos] == "," {
+			// SET NAMES / SET CHARACTER SET take no '='
+			pos++
+			continue
+		}
+		pos++ // skip '='
+
+		valueStart, depth := pos, 0
+		for pos < len(tokens) && (depth > 0 || tokens[pos] != ",") {
+			switch tokens[pos] {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			}
+			pos++
+		}
+		value, valueTypes := tokens[valueStart:pos], types[valueStart:pos]
+		pos++ // skip ','
+
+		switch target {
+		case "sql_mode", "sessionsql_mode", "localsql_mode", "@@sql_mode", "@@session.sql_mode", "@@local.sql_mode":
+		default:
+			continue
+		}
+
+		switch {
+		case len(value) == 1 && valueTypes[0] == TOKEN_QUOTE && len(value[0]) >= 2:
+			mode, ok = parseSQLMode(value[0][1:len(value[0])-1]), true
+		case len(value) == 1 && strings.ToUpper(value[0]) == "DEFAULT":
+			mode, ok = sqlMode{}, true
+		default:
+			return current, false
+		}
+	}
+
+	if !ok {
+		return current, false
+	}
+	return mode, true
+}
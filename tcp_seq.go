@@ -0,0 +1,38 @@
+package main
+
+// seqTracker follows the TCP sequence numbers of one direction of a stream,
+// so segments we've already read can be recognized when they're resent.
+type seqTracker struct {
+	next  uint32
+	valid bool
+
+	// gap is set once a segment starts past where we expected it, meaning
+	// data went missing (or arrived out of order)
+	gap bool
+}
+
+// accept takes a segment whose payload starts at sequence number seq and
+// returns the part of the payload we haven't seen yet. retransmit is set when
+// some or all of the segment was seen before. Comparisons use serial number
+// arithmetic so they survive sequence wraparound.
+func (t *seqTracker) accept(seq uint32, payload []byte) (fresh []byte, retransmit bool) {
+	end := seq + uint32(len(payload))
+	if !t.valid {
+		t.next, t.valid = end, true
+		return payload, false
+	}
+
+	if int32(end-t.next) <= 0 {
+		// Nothing new
+		return nil, true
+	}
+	if int32(seq-t.next) < 0 {
+		// Overlaps what we have; keep only the new tail
+		payload = payload[t.next-seq:]
+		retransmit = true
+	} else if seq != t.next {
+		t.gap = true
+	}
+	t.next = end
+	return payload, retransmit
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+)
+
+// watchList is the set of queries named in -watch-file. Each is tracked and
+// reported however rarely it runs.
+type watchList struct {
+	path    string
+	queries []string
+	counts  map[string]uint64
+}
+
+var watch *watchList
+
+// loadWatchList reads a watch file: one query per line, blank lines and lines
+// starting with # ignored. Lines are canonicalized the same way captured
+// queries are, so either a raw query or its canonical form can be listed.
+// Counts carry over from previous for queries still on the list.
+func loadWatchList(path string, previous *watchList) (*watchList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	w := &watchList{path: path, counts: make(map[string]uint64)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		query := cleanupQuery([]byte(line))
+		if _, dup := w.counts[query]; dup {
+			continue
+		}
+		w.queries = append(w.queries, query)
+		w.counts[query] = 0
+		if previous != nil {
+			w.counts[query] = previous.counts[query]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// observe counts a canonical query if it's on the list and reports whether it was
+func (w *watchList) observe(query string) bool {
+	if _, ok := w.counts[query]; !ok {
+		return false
+	}
+	w.counts[query]++
+	return true
+}
+
+// report prints every watched query with its count, in file order
+func (w *watchList) report() {
+	log.Printf("Watched queries (%s):", w.path)
+	for _, query := range w.queries {
+		log.Printf("%8d  %s", w.counts[query], escapeControlBytes(query))
+	}
+}
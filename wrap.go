@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// wrapWidth is the column -wrap-width hard-wraps verbose output at; 0 leaves
+// lines alone
+var wrapWidth int = 0
+
+// wrapText hard-wraps each line of text at width columns, starting
+// continuation lines with indent spaces. Columns are counted in characters,
+// and ANSI color sequences take up none and are never split.
+func wrapText(text string, width, indent int) string {
+	if width <= 0 {
+		return text
+	}
+	if indent >= width {
+		indent = 0
+	}
+	pad := strings.Repeat(" ", indent)
+
+	var out strings.Builder
+	for n, line := range strings.Split(text, "\n") {
+		if n > 0 {
+			out.WriteByte('\n')
+		}
+		col := 0
+		for i := 0; i < len(line); {
+			// Copy a color sequence whole: ESC [ parameters final-byte
+			if line[i] == 0x1b && i+1 < len(line) && line[i+1] == '[' {
+				end := i + 2
+				for end < len(line) && (line[end] < 0x40 || line[end] > 0x7e) {
+					end++
+				}
+				if end < len(line) {
+					end++
+				}
+				out.WriteString(line[i:end])
+				i = end
+				continue
+			}
+
+			if col == width {
+				out.WriteString("\n" + pad)
+				col = indent
+			}
+			_, size := utf8.DecodeRuneInString(line[i:])
+			out.WriteString(line[i : i+size])
+			col++
+			i += size
+		}
+	}
+	return out.String()
+}
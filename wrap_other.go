@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package main
+
+// terminalWidth is 0 where we can't ask the terminal, leaving -wrap-width to
+// be set explicitly
+func terminalWidth() int {
+	return 0
+}